@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/shlex"
+	lua "github.com/yuin/gopher-lua"
+	"lesiw.io/flag"
+)
+
+// param is a flag or positional argument declared by a command.
+type param struct {
+	name     string // Flags may have aliases, e.g. env,e.
+	flag     bool
+	typ      string // One of string, bool, or int.
+	def      string
+	enum     []string
+	required bool
+	desc     string
+}
+
+func (p *param) key() string {
+	name, _, _ := strings.Cut(p.name, ",")
+	return name
+}
+
+// envName returns the variable that p is exported to commands in.
+func (p *param) envName() string {
+	name := strings.ToUpper(strings.ReplaceAll(p.key(), "-", "_"))
+	return "RUN_ARG_" + name
+}
+
+func (p *param) usage() string {
+	usage := p.desc
+	if len(p.enum) > 0 {
+		usage += fmt.Sprintf(" (one of: %s)", strings.Join(p.enum, ", "))
+	}
+	if p.def != "" {
+		usage += fmt.Sprintf(" (default %s)", p.def)
+	}
+	if p.required {
+		usage += " (required)"
+	}
+	return strings.TrimSpace(usage)
+}
+
+func (p *param) check(val string) error {
+	if p.typ == "int" {
+		if _, err := strconv.Atoi(val); err != nil {
+			return fmt.Errorf("bad value for %s: '%s' is not an int",
+				p.key(), val)
+		}
+	}
+	if len(p.enum) > 0 && !slices.Contains(p.enum, val) {
+		return fmt.Errorf("bad value for %s: '%s' is not one of %s",
+			p.key(), val, strings.Join(p.enum, ", "))
+	}
+	return nil
+}
+
+// splitArgs splits args into run's own flags and the command line that
+// follows them, so that flags after the command name go to the command.
+func splitArgs(set *flag.Set, args []string) (own, cmd []string) {
+	valued := make(map[string]bool)
+	set.Visit(func(f *flag.Flag) {
+		_, isbool := f.Value.(interface{ IsBoolFlag() bool })
+		for _, name := range f.Names {
+			valued[name] = !isbool
+		}
+	})
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return args[:i], args[i+1:]
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			return args[:i], args[i:]
+		case strings.HasPrefix(arg, "--"):
+			name, _, hasval := strings.Cut(arg[2:], "=")
+			if valued[name] && !hasval {
+				i++
+			}
+		default:
+			for j := 1; j < len(arg); j++ {
+				if valued[arg[j:j+1]] {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+		}
+	}
+	return args, nil
+}
+
+// parseArgs validates args against c's parameters and returns them as
+// RUN_ARG_* variables.
+func (c *command) parseArgs(args []string) (map[string]string, error) {
+	env := make(map[string]string)
+	if len(c.params) < 1 {
+		return env, nil
+	}
+	set := flag.NewSet(os.Stderr, c.synopsis())
+	vals := make(map[string]func() string)
+	for _, p := range c.params {
+		if !p.flag {
+			continue
+		}
+		switch p.typ {
+		case "bool":
+			b := new(bool)
+			*b, _ = strconv.ParseBool(p.def)
+			set.BoolVar(b, p.name, p.usage())
+			vals[p.key()] = func() string { return strconv.FormatBool(*b) }
+		case "int":
+			n := new(int)
+			*n, _ = strconv.Atoi(p.def)
+			set.IntVar(n, p.name, p.usage())
+			key, def := p.key(), p.def
+			vals[key] = func() string {
+				if !set.Set(key) {
+					return def
+				}
+				return strconv.Itoa(*n)
+			}
+		default:
+			v := new(string)
+			*v = p.def
+			set.StringVar(v, p.name, p.usage())
+			vals[p.key()] = func() string { return *v }
+		}
+	}
+	if err := set.Parse(args...); err != nil {
+		return nil, errParse
+	}
+	pos := set.Args
+	for _, p := range c.params {
+		var val string
+		var given bool
+		switch {
+		case p.flag:
+			val, given = vals[p.key()](), set.Set(p.key())
+		case len(pos) > 0:
+			val, given, pos = pos[0], true, pos[1:]
+		default:
+			val = p.def
+		}
+		if p.required && !given {
+			return nil, fmt.Errorf("%s: missing required %s", c.name,
+				p.key())
+		}
+		if val != "" {
+			if err := p.check(val); err != nil {
+				return nil, fmt.Errorf("%s: %w", c.name, err)
+			}
+		}
+		env[p.envName()] = val
+	}
+	return env, nil
+}
+
+// synopsis returns a usage line for c.
+func (c *command) synopsis() string {
+	var b strings.Builder
+	b.WriteString("run " + c.name)
+	for _, p := range c.params {
+		if p.flag {
+			b.WriteString(" [FLAGS]")
+			break
+		}
+	}
+	for _, p := range c.params {
+		if p.flag {
+			continue
+		} else if p.required {
+			b.WriteString(" " + strings.ToUpper(p.key()))
+		} else {
+			b.WriteString(" [" + strings.ToUpper(p.key()) + "]")
+		}
+	}
+	return b.String()
+}
+
+// printHelp prints the usage of c, as for run -h COMMAND.
+func (c *command) printHelp() {
+	fmt.Println("Usage:", c.synopsis())
+	if c.desc != "" {
+		fmt.Printf("\n%s\n", c.desc)
+	}
+	var pos strings.Builder
+	set := flag.NewSet(os.Stdout, "")
+	for _, p := range c.params {
+		switch {
+		case p.flag && p.typ == "bool":
+			set.Bool(p.name, p.usage())
+		case p.flag && p.typ == "int":
+			set.Int(p.name, p.usage())
+		case p.flag:
+			set.String(p.name, p.usage())
+		default:
+			fmt.Fprintf(&pos, "  %s\n    \t%s\n",
+				strings.ToUpper(p.key()), p.usage())
+		}
+	}
+	if defaults := set.Defaults(); defaults != "" {
+		fmt.Printf("\n%s\n", defaults)
+	}
+	if pos.Len() > 0 {
+		fmt.Printf("\n%s", pos.String())
+	}
+}
+
+// completions returns the words that can follow c on the command line.
+func (c *command) completions() (words []string) {
+	for _, p := range c.params {
+		if p.flag {
+			for _, name := range strings.Split(p.name, ",") {
+				if len(name) > 1 {
+					words = append(words, "--"+name)
+				} else {
+					words = append(words, "-"+name)
+				}
+			}
+		}
+		words = append(words, p.enum...)
+	}
+	return
+}
+
+// loadParams reads the parameters of a file-based command from its header,
+// the comment lines at the top of the script:
+//
+//	#run:flag NAME[,ALIAS] [type=TYPE] [default=V] [enum=A,B] [required]
+//	  [desc=TEXT]
+//	#run:arg NAME [type=TYPE] [default=V] [enum=A,B] [required] [desc=TEXT]
+//	#run:cwd
+func (c *command) loadParams() error {
+	if c.path == "" || c.params != nil {
+		return nil
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		kind, spec, _ := strings.Cut(line, " ")
+		if kind == "run:cwd" {
+			c.incwd = true
+			continue
+		} else if kind != "run:flag" && kind != "run:arg" {
+			continue
+		}
+		p, err := parseParam(kind == "run:flag", spec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.path, err)
+		}
+		c.params = append(c.params, p)
+	}
+	err = scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return nil // Not a script.
+	}
+	return err
+}
+
+func parseParam(isflag bool, spec string) (p param, err error) {
+	fields, err := shlex.Split(spec)
+	if err != nil {
+		return p, fmt.Errorf("bad parameter '%s': %w", spec, err)
+	} else if len(fields) < 1 {
+		return p, fmt.Errorf("bad parameter: no name")
+	}
+	p = param{name: fields[0], flag: isflag, typ: "string"}
+	for _, field := range fields[1:] {
+		key, val, _ := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			p.typ = val
+		case "default":
+			p.def = val
+		case "enum":
+			p.enum = strings.Split(val, ",")
+		case "required":
+			p.required = true
+		case "desc":
+			p.desc = val
+		default:
+			return p, fmt.Errorf("bad parameter '%s': unknown field '%s'",
+				p.name, key)
+		}
+	}
+	return p, p.validate()
+}
+
+func (p *param) validate() error {
+	if p.typ != "string" && p.typ != "bool" && p.typ != "int" {
+		return fmt.Errorf("bad parameter '%s': unknown type '%s'",
+			p.name, p.typ)
+	} else if p.typ == "bool" && !p.flag {
+		return fmt.Errorf("bad parameter '%s': only flags can be bool",
+			p.name)
+	}
+	return nil
+}
+
+// luaParams reads the flags and args fields of a run.command table.
+func luaParams(L *lua.LState, t *lua.LTable) (params []param) {
+	for _, field := range []string{"flags", "args"} {
+		list, ok := t.RawGetString(field).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		list.ForEach(func(_, v lua.LValue) {
+			pt, ok := v.(*lua.LTable)
+			if !ok {
+				L.ArgError(1, field+" must be a list of tables")
+			}
+			p := param{
+				name:     lua.LVAsString(pt.RawGetString("name")),
+				flag:     field == "flags",
+				typ:      lua.LVAsString(pt.RawGetString("type")),
+				def:      lua.LVAsString(pt.RawGetString("default")),
+				required: lua.LVAsBool(pt.RawGetString("required")),
+				desc:     lua.LVAsString(pt.RawGetString("desc")),
+			}
+			if p.typ == "" {
+				p.typ = "string"
+			}
+			if enum, ok := pt.RawGetString("enum").(*lua.LTable); ok {
+				enum.ForEach(func(_, v lua.LValue) {
+					p.enum = append(p.enum, v.String())
+				})
+			}
+			if p.name == "" {
+				L.ArgError(1, field+" need names")
+			} else if err := p.validate(); err != nil {
+				L.ArgError(1, err.Error())
+			}
+			params = append(params, p)
+		})
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		own  []string
+		cmd  []string
+	}{
+		{nil, nil, nil},
+		{[]string{"build"}, []string{}, []string{"build"}},
+		{[]string{"-v", "build", "-v"}, []string{"-v"},
+			[]string{"build", "-v"}},
+		{[]string{"-g", "pkg", "build"}, []string{"-g", "pkg"},
+			[]string{"build"}},
+		{[]string{"-vg", "pkg", "build"}, []string{"-vg", "pkg"},
+			[]string{"build"}},
+		{[]string{"-gpkg", "build"}, []string{"-gpkg"}, []string{"build"}},
+		{[]string{"--why", "build", "x"}, []string{"--why", "build"},
+			[]string{"x"}},
+		{[]string{"--why=build", "x"}, []string{"--why=build"},
+			[]string{"x"}},
+		{[]string{"--lock", "db", "--", "-x"}, []string{"--lock", "db"},
+			[]string{"-x"}},
+		{[]string{"-v", "-"}, []string{"-v"}, []string{"-"}},
+		{[]string{"-v", "-l"}, []string{"-v", "-l"}, nil},
+	}
+	for _, tt := range tests {
+		own, cmd := splitArgs(flags, tt.args)
+		if !slices.Equal(own, tt.own) || !slices.Equal(cmd, tt.cmd) {
+			t.Errorf("splitArgs(%q) = %q, %q, want %q, %q",
+				tt.args, own, cmd, tt.own, tt.cmd)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	c := &command{name: "deploy", params: []param{
+		{name: "env,e", flag: true, typ: "string", def: "dev",
+			enum: []string{"dev", "prod"}},
+		{name: "dry-run", flag: true, typ: "bool"},
+		{name: "target", typ: "string", required: true},
+		{name: "count", typ: "int", def: "1"},
+		{name: "jobs,j", flag: true, typ: "int"},
+	}}
+	tests := []struct {
+		args []string
+		want map[string]string
+		err  bool
+	}{{
+		args: []string{"web"},
+		want: map[string]string{
+			"RUN_ARG_ENV":     "dev",
+			"RUN_ARG_DRY_RUN": "false",
+			"RUN_ARG_TARGET":  "web",
+			"RUN_ARG_COUNT":   "1",
+			"RUN_ARG_JOBS":    "",
+		},
+	}, {
+		args: []string{"-e", "prod", "--dry-run", "-j", "4", "web", "3"},
+		want: map[string]string{
+			"RUN_ARG_ENV":     "prod",
+			"RUN_ARG_DRY_RUN": "true",
+			"RUN_ARG_TARGET":  "web",
+			"RUN_ARG_COUNT":   "3",
+			"RUN_ARG_JOBS":    "4",
+		},
+	}, {
+		args: []string{},
+		err:  true, // Missing target.
+	}, {
+		args: []string{"--env=staging", "web"},
+		err:  true,
+	}, {
+		args: []string{"web", "many"},
+		err:  true,
+	}, {
+		args: []string{"--jobs=many", "web"},
+		err:  true,
+	}, {
+		args: []string{"--jobs=", "web"},
+		err:  true,
+	}}
+	for _, tt := range tests {
+		got, err := c.parseArgs(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseArgs(%q) = %v, want error", tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q) err: %v", tt.args, err)
+		} else if !maps.Equal(got, tt.want) {
+			t.Errorf("parseArgs(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgsUnknownFlag(t *testing.T) {
+	c := &command{name: "x", params: []param{
+		{name: "v", flag: true, typ: "bool"},
+	}}
+	if _, err := c.parseArgs([]string{"--nope"}); !errors.Is(err, errParse) {
+		t.Errorf("parseArgs(--nope) = %v, want errParse", err)
+	}
+}
+
+func TestParseArgsIntFlagDefault(t *testing.T) {
+	c := &command{name: "x", params: []param{
+		{name: "jobs", flag: true, typ: "int", def: "some"},
+	}}
+	if _, err := c.parseArgs(nil); err == nil {
+		t.Error("parseArgs() with a non-int default succeeded")
+	}
+	if _, err := c.parseArgs([]string{"--jobs", "2"}); err != nil {
+		t.Errorf("parseArgs(--jobs 2) = %v", err)
+	}
+}
+
+func TestParseArgsNoParams(t *testing.T) {
+	c := &command{name: "x"}
+	got, err := c.parseArgs([]string{"--anything", "goes"})
+	if err != nil || len(got) != 0 {
+		t.Errorf("parseArgs() = %v, %v, want no variables", got, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var errAuth = errors.New("authentication required")
+
+type credential struct {
+	user, pass string
+}
+
+// hostCredential finds credentials for host, trying in order:
+//
+//  1. RUNAUTH, a comma-separated list of host=[user:]ENVVAR entries, where
+//     host may be a path.Match pattern and ENVVAR names a variable holding
+//     a token.
+//  2. The user's .netrc, or the file named by NETRC.
+//  3. git credential helpers, via git credential fill.
+//
+// Without fallback, only RUNAUTH and .netrc machine entries naming host are
+// tried. The .netrc default entry and credential helpers are for hosts that
+// asked for credentials.
+func hostCredential(host string, fallback bool) *credential {
+	if c := tokenCredential(host); c != nil {
+		return c
+	} else if c := netrcCredential(host, fallback); c != nil {
+		return c
+	} else if !fallback {
+		return nil
+	}
+	return gitCredential(host)
+}
+
+func tokenCredential(host string) *credential {
+	for _, entry := range strings.Split(os.Getenv("RUNAUTH"), ",") {
+		pattern, ref, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); !ok {
+			continue
+		}
+		user, envvar, ok := strings.Cut(ref, ":")
+		if !ok {
+			user, envvar = "oauth2", ref
+		}
+		if token := os.Getenv(envvar); token != "" {
+			return &credential{user, token}
+		}
+	}
+	return nil
+}
+
+func netrcCredential(host string, fallback bool) *credential {
+	file := os.Getenv("NETRC")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		file = filepath.Join(home, ".netrc")
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var c, cur *credential
+	fields := strings.Fields(string(buf))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine", "default":
+			if c != nil {
+				return c
+			}
+			cur = nil
+			if fields[i] == "default" {
+				if fallback {
+					cur = &credential{}
+				}
+			} else if i++; i < len(fields) && fields[i] == host {
+				cur = &credential{}
+			}
+		case "login", "password":
+			if i++; i < len(fields) && cur != nil {
+				if fields[i-1] == "login" {
+					cur.user = fields[i]
+				} else {
+					cur.pass = fields[i]
+				}
+			}
+			if cur != nil && cur.pass != "" {
+				c = cur
+			}
+		}
+	}
+	return c
+}
+
+func gitCredential(host string) *credential {
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=" + host + "\n\n")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	c := &credential{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		key, val, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "username":
+			c.user = val
+		case "password":
+			c.pass = val
+		}
+	}
+	if c.pass == "" {
+		return nil
+	}
+	return c
+}
+
+// authorize adds credentials for the request's host to requests made over
+// https, as found by hostCredential. It reports whether it found any.
+func authorize(r *http.Request, fallback bool) bool {
+	if r.URL.Scheme != "https" {
+		return false
+	}
+	c := hostCredential(r.URL.Hostname(), fallback)
+	if c == nil {
+		return false
+	}
+	r.SetBasicAuth(c.user, c.pass)
+	return true
+}
+
+// authRedirect follows redirects, passing credentials on only to the scheme
+// and host they were sent to.
+func authRedirect(r *http.Request, via []*http.Request) error {
+	if r.Response.StatusCode < 300 || r.Response.StatusCode >= 400 {
+		return http.ErrUseLastResponse
+	}
+	r.Header.Del("Authorization")
+	prev := via[len(via)-1]
+	auth := prev.Header.Get("Authorization")
+	if auth != "" && r.URL.Scheme == prev.URL.Scheme &&
+		r.URL.Host == prev.URL.Host {
+		r.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// gitAuthEnv returns the environment for git commands that access url.
+// Token credentials are passed as an extra HTTP header through git's
+// environment-based config, so they do not appear in the process list.
+// When run is not interactive, git is told not to prompt for credentials.
+func gitAuthEnv(url string) []string {
+	env := os.Environ()
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		env = append(env, "GIT_TERMINAL_PROMPT=0")
+		if os.Getenv("GIT_SSH_COMMAND") == "" {
+			env = append(env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+		}
+	}
+	u, err := neturl.Parse(url)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return env
+	}
+	c := tokenCredential(u.Hostname())
+	if c == nil {
+		return env // git consults .netrc and credential helpers itself.
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(c.user + ":" + c.pass))
+	return append(env,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http."+u.Scheme+"://"+u.Host+"/.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+	)
+}
+
+func authError(url string) error {
+	return fmt.Errorf("%w for '%s': configure a git credential helper, "+
+		".netrc, or RUNAUTH", errAuth, url)
+}
+
+// gitAuthError explains a git failure caused by missing credentials.
+func gitAuthError(url string, stderr string) error {
+	for _, msg := range []string{
+		"terminal prompts disabled",
+		"could not read Username",
+		"Authentication failed",
+		"Permission denied (publickey",
+	} {
+		if strings.Contains(stderr, msg) {
+			return authError(url)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNetrcCredential(t *testing.T) {
+	tests := []struct {
+		name     string
+		netrc    string
+		host     string
+		fallback bool
+		want     *credential
+	}{{
+		name:  "machine",
+		netrc: "machine example.com login alice password s3cret\n",
+		host:  "example.com",
+		want:  &credential{"alice", "s3cret"},
+	}, {
+		name: "second machine",
+		netrc: "machine other.com login bob password hunter2\n" +
+			"machine example.com\n\tlogin alice\n\tpassword s3cret\n",
+		host: "example.com",
+		want: &credential{"alice", "s3cret"},
+	}, {
+		name:  "other machine",
+		netrc: "machine other.com login bob password hunter2\n",
+		host:  "example.com",
+		want:  nil,
+	}, {
+		name: "default",
+		netrc: "machine other.com login bob password hunter2\n" +
+			"default login anon password guest\n",
+		host:     "example.com",
+		fallback: true,
+		want:     &credential{"anon", "guest"},
+	}, {
+		name:  "default without fallback",
+		netrc: "default login anon password guest\n",
+		host:  "example.com",
+		want:  nil,
+	}, {
+		name: "machine before default",
+		netrc: "machine example.com login alice password s3cret\n" +
+			"default login anon password guest\n",
+		host:     "example.com",
+		fallback: true,
+		want:     &credential{"alice", "s3cret"},
+	}, {
+		name:  "no password",
+		netrc: "machine example.com login alice\n",
+		host:  "example.com",
+		want:  nil,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "netrc")
+			if err := os.WriteFile(file, []byte(tt.netrc), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("NETRC", file)
+			got := netrcCredential(tt.host, tt.fallback)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || *got != *tt.want:
+				t.Errorf("netrcCredential(%q) = %v, want %v",
+					tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetrcCredentialMissing(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	if got := netrcCredential("example.com", true); got != nil {
+		t.Errorf("netrcCredential() = %v, want nil", got)
+	}
+}
+
+func TestAuthorizeHttp(t *testing.T) {
+	t.Setenv("RUNAUTH", "example.com=TOKEN")
+	t.Setenv("TOKEN", "s3cret")
+	for url, want := range map[string]bool{
+		"https://example.com/pkg": true,
+		"http://example.com/pkg":  false,
+		"https://other.com/pkg":   false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if got := authorize(r, false); got != want {
+			t.Errorf("authorize(%s) = %v, want %v", url, got, want)
+		}
+		if _, _, ok := r.BasicAuth(); ok != want {
+			t.Errorf("authorize(%s) set credentials = %v, want %v",
+				url, ok, want)
+		}
+	}
+}
+
+func TestAuthRedirect(t *testing.T) {
+	from := httptest.NewRequest(http.MethodGet, "https://example.com/a", nil)
+	from.SetBasicAuth("alice", "s3cret")
+	for url, want := range map[string]bool{
+		"https://example.com/b":      true,
+		"http://example.com/b":       false,
+		"https://other.com/b":        false,
+		"https://example.com:8443/b": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.Response = &http.Response{StatusCode: http.StatusFound}
+		r.Header = from.Header.Clone()
+		if err := authRedirect(r, []*http.Request{from}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := r.BasicAuth(); ok != want {
+			t.Errorf("redirect to %s kept credentials = %v, want %v",
+				url, ok, want)
+		}
+	}
+}
+
+func TestFetchMetaChallenge(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	err := os.WriteFile(netrc, []byte("default login anon password guest\n"),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NETRC", netrc)
+	t.Setenv("RUNAUTH", "")
+	var sent []bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _, ok := r.BasicAuth()
+			sent = append(sent, ok)
+			if !ok && r.URL.Path == "/private" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+	defer srv.Close()
+	transport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	defer func() { http.DefaultTransport = transport }()
+
+	resp, err := fetchMeta(srv.URL + "/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !slices.Equal(sent, []bool{false}) {
+		t.Errorf("public fetch sent credentials %v, want [false]", sent)
+	}
+	sent = nil
+	if resp, err = fetchMeta(srv.URL + "/private"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("private fetch status = %d, want 200", resp.StatusCode)
+	}
+	if !slices.Equal(sent, []bool{false, true}) {
+		t.Errorf("private fetch sent credentials %v, want [false true]",
+			sent)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// hermeticenv lists the variables a hermetic build inherits.
+// RUNHERMETICENV adds to it.
+var hermeticenv = []string{
+	"PATH", "TERM", "LANG", "LC_ALL", "TZ",
+	"RUNRPC", "RUNRPCTOKEN", "RUNCTRCTL", "RUNCTRDEBUG",
+}
+
+// hostPlatform is the GOOS/GOARCH that packages are built for by default.
+var hostPlatform = runtime.GOOS + "/" + runtime.GOARCH
+
+// callerenv lists the variables that describe where the user ran run.
+// Package builds and package contexts do not inherit them, as they would
+// point a nested run at the importing project.
+var callerenv = []string{"RUNROOT", "RUNCWD", "RUNRELDIR"}
+
+// buildCtx describes what a package is being built for.
+type buildCtx struct {
+	platform string   // GOOS/GOARCH of the importer.
+	imports  []string // The import chain, passed on in RUNIMPORTS.
+}
+
+// pkgManifest describes how to build a package.
+// It is read from .run/.runpkg, which holds lines of the form:
+//
+//	build COMMAND [ARGS...]
+//	out DIR
+//	out GOOS/GOARCH DIR
+//
+// By default, packages are built with "run" and their output is in out.
+type pkgManifest struct {
+	build []string
+	out   string
+}
+
+func loadManifest(src, platform string) (*pkgManifest, error) {
+	m := &pkgManifest{out: "out"}
+	if run, err := os.Executable(); err == nil {
+		m.build = []string{run}
+	} else {
+		m.build = []string{"run"}
+	}
+	file := filepath.Join(src, ".run", ".runpkg")
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open package manifest: %w", err)
+	}
+	defer f.Close()
+	var platformOut string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, val, _ := strings.Cut(line, " ")
+		val = strings.TrimSpace(val)
+		switch key {
+		case "build":
+			if m.build, err = shlex.Split(val); err != nil {
+				return nil, fmt.Errorf("bad build (.runpkg line %d): %w",
+					n, err)
+			}
+		case "out":
+			dir, out, ok := strings.Cut(val, " ")
+			if !ok {
+				m.out = val
+			} else if dir == platform {
+				platformOut = strings.TrimSpace(out)
+			}
+		default:
+			return nil, fmt.Errorf("bad key (.runpkg line %d): '%s'", n, key)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read package manifest: %w", err)
+	}
+	if platformOut != "" {
+		m.out = platformOut
+	}
+	if len(m.build) < 1 || m.out == "" {
+		return nil, fmt.Errorf("bad package manifest: %s", file)
+	}
+	m.out = filepath.Clean(filepath.FromSlash(m.out))
+	if filepath.IsAbs(m.out) || strings.HasPrefix(m.out, "..") {
+		return nil, fmt.Errorf("bad package output directory: %s", m.out)
+	}
+	return m, nil
+}
+
+// buildCmd returns the command that builds the package at src.
+func buildCmd(src string, m *pkgManifest, b buildCtx) (*exec.Cmd, error) {
+	var err error
+	cmd := exec.Command(m.build[0], m.build[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = src
+	if !*hermetic && os.Getenv("RUNHERMETIC") != "1" {
+		cmd.Stdin = os.Stdin
+		cmd.Env = os.Environ()
+		if ctr := os.Getenv("RUNBUILDCTR"); ctr != "" {
+			cmd.Env = append(cmd.Env, "RUNCTR="+ctr)
+		}
+	} else if cmd.Env, err = hermeticEnv(); err != nil {
+		return nil, err
+	}
+	cmd.Env = slices.DeleteFunc(cmd.Env, func(kv string) bool {
+		k, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(callerenv, k)
+	})
+	cmd.Env = append(cmd.Env,
+		"RUNIMPORTS="+strings.Join(b.imports, " "),
+		"RUNPLATFORM="+b.platform,
+	)
+	return cmd, nil
+}
+
+// hermeticEnv returns a clean build environment with HOME and TMPDIR
+// pointing at scratch directories.
+func hermeticEnv() (env []string, err error) {
+	allow := append([]string{}, hermeticenv...)
+	for _, name := range strings.Split(os.Getenv("RUNHERMETICENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allow = append(allow, name)
+		}
+	}
+	for _, name := range allow {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	scratch, err := cacheTemp()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"HOME", "TMPDIR"} {
+		path := filepath.Join(scratch, strings.ToLower(dir))
+		if err = os.Mkdir(path, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create build %s: %w", dir, err)
+		}
+		env = append(env, dir+"="+path)
+	}
+	if ctr := os.Getenv("RUNBUILDCTR"); ctr != "" {
+		env = append(env, "RUNCTR="+ctr)
+	}
+	return env, nil
+}
+
+// buildOut builds the package at src and returns its output directory
+// and the hash of its contents.
+func buildOut(src string, b buildCtx) (out, hash string, err error) {
+	m, err := loadManifest(src, b.platform)
+	if err != nil {
+		return "", "", err
+	}
+	cmd, err := buildCmd(src, m, b)
+	if err != nil {
+		return "", "", err
+	}
+	if err = cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("%s failed: %w",
+			filepath.Base(m.build[0]), err)
+	}
+	out = filepath.Join(src, m.out)
+	if _, err = os.Stat(out); err != nil {
+		return "", "", fmt.Errorf("no output directory: %w", err)
+	}
+	hash, err = hashDir(out, "", hash1)
+	return
+}
+
+// checkReproducible builds a pristine copy of a package's source
+// and compares its output hash to the first build's.
+func checkReproducible(pristine, hash string, b buildCtx) error {
+	_, hash2, err := buildOut(pristine, b)
+	if err != nil {
+		return fmt.Errorf("reproducibility build failed: %w", err)
+	}
+	if hash != hash2 {
+		return fmt.Errorf("build is not reproducible: got %s, then %s",
+			hash, hash2)
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst, preserving symlinks.
+func copyTree(src, dst string) error {
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(p, target)
+		}
+	}
+	return filepath.WalkDir(src, walk)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildCmdEnv(t *testing.T) {
+	t.Setenv("RUNROOT", "/caller")
+	t.Setenv("RUNCWD", "/caller/sub")
+	t.Setenv("RUNRELDIR", "sub")
+	m := &pkgManifest{build: []string{"true"}, out: "out"}
+	cmd, err := buildCmd(t.TempDir(), m, buildCtx{
+		platform: "linux/arm64",
+		imports:  []string{"a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imports, platform bool
+	for _, kv := range cmd.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		for _, name := range callerenv {
+			if k == name {
+				t.Errorf("build env has %s", kv)
+			}
+		}
+		if k == "RUNIMPORTS" {
+			imports = v == "a"
+		} else if k == "RUNPLATFORM" {
+			platform = v == "linux/arm64"
+		}
+	}
+	if !imports {
+		t.Error("build env lacks RUNIMPORTS=a")
+	}
+	if !platform {
+		t.Error("build env lacks RUNPLATFORM=linux/arm64")
+	}
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 
+// cacheHome overrides the user cache directory, as in tests.
+var cacheHome string
+
 func cacheDir(path ...string) (cache string, err error) {
-	if cache, err = os.UserCacheDir(); err != nil {
-		return "", fmt.Errorf("failed to get user cache directory: %s", err)
+	if cache = cacheHome; cache == "" {
+		if cache, err = os.UserCacheDir(); err != nil {
+			return "", fmt.Errorf(
+				"failed to get user cache directory: %s", err)
+		}
 	}
 	cache = filepath.Join(cache, "run", filepath.Join(path...))
 	if err = os.MkdirAll(cache, 0755); err != nil {
@@ -16,3 +28,395 @@ func cacheDir(path ...string) (cache string, err error) {
 	}
 	return
 }
+
+// cacheLock takes an exclusive lock on a cache entry, waiting for other run
+// processes to release it. The returned function releases the lock.
+func cacheLock(path ...string) (unlock func(), err error) {
+	locks, err := cacheDir("locks")
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(locks, strings.Join(path, "-")+".lock")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock '%s': %w", name, err)
+	}
+	if err = flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock '%s': %w", name, err)
+	}
+	return func() {
+		_ = funlock(f)
+		f.Close()
+	}, nil
+}
+
+// cacheTemp creates a temporary directory in the cache, so that it can be
+// renamed into place atomically. It is removed when run exits.
+func cacheTemp() (string, error) {
+	tmp, err := cacheDir("tmp")
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(tmp, "run")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defers.add(func() { _ = removeAll(dir) })
+	return dir, nil
+}
+
+// cacheRename atomically moves src to dst, tolerating a dst that another
+// run process has already published.
+func cacheRename(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		if _, serr := os.Lstat(dst); serr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// registerProject records the project root under its runid
+// so that garbage collection can find its lockfile. Projects without a
+// .runid can share an id, as with two clones of one repository, so each
+// id lists every root it was seen at, one per line.
+func registerProject() error {
+	projects, err := cacheDir("projects")
+	if err != nil {
+		return err
+	}
+	id := runid.String()
+	path := filepath.Join(projects, id)
+	if slices.Contains(projectRoots(path), root) {
+		return nil
+	}
+	unlock, err := cacheLock("projects", id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	roots := projectRoots(path)
+	if slices.Contains(roots, root) {
+		return nil // Registered while waiting for the lock.
+	}
+	if err = writeProjectRoots(path, append(roots, root)); err != nil {
+		return fmt.Errorf("failed to register project: %w", err)
+	}
+	return nil
+}
+
+func projectRoots(path string) (roots []string) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line != "" {
+			roots = append(roots, line)
+		}
+	}
+	return
+}
+
+func writeProjectRoots(path string, roots []string) error {
+	if len(roots) < 1 {
+		return os.Remove(path)
+	}
+	return os.WriteFile(path, []byte(strings.Join(roots, "\n")+"\n"), 0644)
+}
+
+// liveRoots returns the roots registered under id that still exist and
+// still have that id, and forgets the rest.
+func liveRoots(projects, id string) []string {
+	unlock, err := cacheLock("projects", id)
+	if err != nil {
+		return nil
+	}
+	defer unlock()
+	path := filepath.Join(projects, id)
+	roots := projectRoots(path)
+	live := slices.DeleteFunc(slices.Clone(roots), func(dir string) bool {
+		if _, err := os.Stat(dir); err != nil {
+			return true // Project is gone.
+		}
+		pid, err := getProjectId(dir)
+		return err != nil || pid.String() != id
+	})
+	if len(live) != len(roots) {
+		_ = writeProjectRoots(path, live)
+	}
+	return live
+}
+
+// cacheRoots returns the store ids and source revisions referenced by the
+// lockfiles of known projects, keyed by id or rev and valued by the urls
+// that reference them.
+func cacheRoots() (ids, revs map[string][]string, err error) {
+	ids, revs = make(map[string][]string), make(map[string][]string)
+	projects, err := cacheDir("projects")
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(projects)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read projects: %w", err)
+	}
+	var lockdirs []string
+	for _, e := range entries {
+		lockdirs = append(lockdirs, liveRoots(projects, e.Name())...)
+	}
+	store, err := cacheDir("store")
+	if err != nil {
+		return
+	}
+	for len(lockdirs) > 0 {
+		env := &runEnv{
+			path:    lockdirs[0],
+			locks:   make(map[string]string),
+			lockids: make(map[string]string),
+		}
+		lockdirs = lockdirs[1:]
+		if err := env.LoadLocks(); err != nil {
+			continue
+		}
+		for url, rev := range env.locks {
+			revs[rev] = append(revs[rev], url)
+			for _, id := range storeIds(rev) {
+				if _, ok := ids[id]; !ok {
+					lockdirs = append(lockdirs, filepath.Join(store, id))
+				}
+				ids[id] = append(ids[id], url)
+			}
+		}
+	}
+	return
+}
+
+// storeIds returns the ids of the store entries built from rev,
+// for any platform.
+func storeIds(rev string) (ids []string) {
+	bysrc, err := cacheDir("store", "by-src")
+	if err != nil {
+		return
+	}
+	links, _ := filepath.Glob(filepath.Join(bysrc, rev+"@*"))
+	for _, link := range links {
+		if path, err := filepath.EvalSymlinks(link); err == nil {
+			ids = append(ids, filepath.Base(path))
+		}
+	}
+	return
+}
+
+func cacheGc() error {
+	ids, revs, err := cacheRoots()
+	if err != nil {
+		return err
+	}
+	var freed int64
+	bysrc, err := cacheDir("store", "by-src")
+	if err != nil {
+		return err
+	}
+	n, err := cacheSweep(bysrc, "by-src", func(name string) bool {
+		_, err := filepath.EvalSymlinks(filepath.Join(bysrc, name))
+		rev, _, keyed := strings.Cut(name, "@")
+		_, used := revs[rev]
+		return used && keyed && err == nil
+	})
+	if err != nil {
+		return err
+	}
+	freed += n
+	files, err := cacheDir("files")
+	if err != nil {
+		return err
+	}
+	urls, err := cacheDir("urls")
+	if err != nil {
+		return err
+	}
+	keep := map[string]func(string) bool{
+		"store": func(name string) bool {
+			_, ok := ids[name]
+			return ok || name == "by-src"
+		},
+		"src": func(name string) bool {
+			_, ok := revs[name]
+			return ok
+		},
+		"bin": func(name string) bool {
+			return strings.HasPrefix(name, "run-"+version+"-")
+		},
+		"urls": func(name string) bool {
+			info, err := os.Stat(filepath.Join(urls, name))
+			return err == nil && time.Since(info.ModTime()) <= urlttl
+		},
+		"files": func(name string) bool {
+			// Pool files are unused once no store entry links to them.
+			nlink, err := getNlink(filepath.Join(files, name))
+			return err != nil || nlink > 1
+		},
+	}
+	for _, name := range []string{"store", "src", "bin", "files", "urls"} {
+		path, err := cacheDir(name)
+		if err != nil {
+			return err
+		}
+		var lock string
+		if name == "store" || name == "src" {
+			lock = name
+		}
+		n, err := cacheSweep(path, lock, keep[name])
+		if err != nil {
+			return err
+		}
+		freed += n
+	}
+	fmt.Printf("freed %s\n", fmtSize(freed))
+	return nil
+}
+
+// cacheSweep removes the entries of dir that keep rejects
+// and returns the number of bytes freed. If lock is set, each entry is
+// removed under its cacheLock, so that entries being published by other
+// run processes are not swept out from under them.
+func cacheSweep(dir, lock string, keep func(string) bool) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read '%s': %w", dir, err)
+	}
+	var freed int64
+	for _, e := range entries {
+		if keep(e.Name()) {
+			continue
+		}
+		n, err := cacheRemove(dir, lock, e.Name())
+		if err != nil {
+			return freed, err
+		}
+		freed += n
+	}
+	return freed, nil
+}
+
+func cacheRemove(dir, lock, name string) (int64, error) {
+	if lock != "" {
+		unlock, err := cacheLock(lock, name)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
+	path := filepath.Join(dir, name)
+	size := dirSize(path)
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "removing %s\n", path)
+	}
+	if err := removeAll(path); err != nil {
+		return 0, fmt.Errorf("failed to remove '%s': %w", path, err)
+	}
+	return size, nil
+}
+
+func cacheInfo() error {
+	ids, _, err := cacheRoots()
+	if err != nil {
+		return err
+	}
+	store, err := cacheDir("store")
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(store)
+	if err != nil {
+		return fmt.Errorf("failed to read store: %w", err)
+	}
+	for _, e := range entries {
+		if e.Name() == "by-src" {
+			continue
+		}
+		urls := ids[e.Name()]
+		sort.Strings(urls)
+		desc := "<unused>"
+		if len(urls) > 0 {
+			desc = strings.Join(urls, " ")
+		}
+		size := dirSize(filepath.Join(store, e.Name()))
+		fmt.Printf("%9s  %s  %s\n", fmtSize(size), e.Name(), desc)
+	}
+	for _, name := range []string{"store", "src", "bin"} {
+		path, err := cacheDir(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%9s  %s\n", fmtSize(dirSize(path)), name)
+	}
+	return nil
+}
+
+func cacheClean() error {
+	cache, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	never := func(string) bool { return false }
+	for _, name := range []string{"store/by-src", "store", "src"} {
+		_, err := cacheSweep(filepath.Join(cache, name),
+			filepath.Base(name), never)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove cache: %w", err)
+		}
+	}
+	for _, name := range []string{
+		"store", "src", "bin", "files", "tmp", "urls",
+	} {
+		if err := removeAll(filepath.Join(cache, name)); err != nil {
+			return fmt.Errorf("failed to remove cache: %w", err)
+		}
+	}
+	return nil
+}
+
+func dirSize(path string) (size int64) {
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+func fmtSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// removeAll is like os.RemoveAll, but also removes read-only directories.
+func removeAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0755)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testCache points the cache at a temp directory for the rest of the test.
+func testCache(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := cacheHome
+	cacheHome = dir
+	t.Cleanup(func() { cacheHome = old })
+	return dir
+}
+
+// cacheTestClone makes a clone of remote without a .runid,
+// locked to rev, and registers it as run would.
+func cacheTestClone(t *testing.T, remote, rev string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", remote},
+	} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	lock := filepath.Join(dir, ".run", ".runlock")
+	if err := os.MkdirAll(filepath.Dir(lock), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(lock, []byte("example.com/pkg "+rev+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldroot, oldid := root, runid
+	defer func() { root, runid = oldroot, oldid }()
+	root = dir
+	if runid, err = getProjectId(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = registerProject(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCacheRootsClones(t *testing.T) {
+	testCache(t)
+	remote := "https://example.com/project.git"
+	cacheTestClone(t, remote, "rev1")
+	two := cacheTestClone(t, remote, "rev2")
+	id, err := getProjectId(two)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, err := cacheDir("projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(projects, id.String())
+	if roots := projectRoots(file); len(roots) != 2 {
+		t.Fatalf("roots of %s = %q, want both clones", id, roots)
+	}
+	_, revs, err := cacheRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range []string{"rev1", "rev2"} {
+		if _, ok := revs[rev]; !ok {
+			t.Errorf("cacheRoots() lacks %s, locked by a clone", rev)
+		}
+	}
+
+	if err := os.RemoveAll(two); err != nil {
+		t.Fatal(err)
+	}
+	if _, revs, err = cacheRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := revs["rev2"]; ok {
+		t.Error("cacheRoots() kept rev2 of a removed clone")
+	}
+	if roots := projectRoots(file); slices.Contains(roots, two) {
+		t.Errorf("roots of %s = %q, want removed clone forgotten", id, roots)
+	}
+}
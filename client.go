@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+var errNotNested = errors.New("not run by run: RUNRPC is not set")
+
+// clientDial connects to the run process that started this one.
+func clientDial() (*rpc.Client, error) {
+	if os.Getenv("RUNRPC") == "" {
+		return nil, errNotNested
+	}
+	return rpcDial(baseEnv())
+}
+
+// logCommand logs a message through the top-level run process,
+// as for run --log LEVEL MSG [KEY=VALUE...].
+func logCommand(level string, args []string) error {
+	if !slices.Contains(logLevels, level) {
+		return fmt.Errorf("bad log level '%s': must be one of %s", level,
+			strings.Join(logLevels, ", "))
+	} else if len(args) < 1 {
+		return errors.New("no log message given")
+	}
+	req := &LogReq{Time: time.Now(), Level: level, Msg: args[0]}
+	for _, attr := range args[1:] {
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return fmt.Errorf("bad log attribute '%s': want KEY=VALUE",
+				attr)
+		}
+		req.Attrs = append(req.Attrs, k, v)
+	}
+	client, err := clientDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return rpcCall(client, "RpcSrv.Log", req, &LogRes{})
+}
+
+// lockCommand runs argv while holding the named lock,
+// as for run --lock NAME -- CMD [ARGS...].
+func lockCommand(name string, argv []string) error {
+	if len(argv) < 1 {
+		return errors.New("no command given")
+	}
+	client, err := clientDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close() // Also releases the lock.
+	req := &LockReq{Name: name}
+	if err = rpcCall(client, "RpcSrv.Lock", req, &LockRes{}); err != nil {
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("error running command: %s", err)
+	}
+	return rpcCall(client, "RpcSrv.Unlock", req, &LockRes{})
+}
+
+// onExitCommand registers argv to run in the working directory when the
+// top-level run process exits, as for run --on-exit CMD [ARGS...].
+func onExitCommand(argv []string) error {
+	if len(argv) < 1 {
+		return errors.New("no command given")
+	}
+	client, err := clientDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	req := &CleanupReq{Argv: argv, Dir: cwd, Env: os.Environ()}
+	return rpcCall(client, "RpcSrv.AddCleanup", req, &CleanupRes{})
+}
+
+// resolveCommand prints what argv would run, as for run --resolve CMD:
+// the path of a file-based command, or the command line of a command
+// registered by init.lua.
+func resolveCommand(argv []string) error {
+	if len(argv) < 1 {
+		return errors.New("no command given")
+	}
+	client, err := clientDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	req := &ResolveReq{
+		Ctx:  strings.Split(os.Getenv("RUNPKGS"), ":"),
+		Argv: argv,
+	}
+	var res ResolveRes
+	if err = rpcCall(client, "RpcSrv.ResolveCommand", req, &res); err != nil {
+		return err
+	}
+	if res.Path != "" {
+		fmt.Println(res.Path)
+	} else {
+		fmt.Println(strings.Join(res.Argv, " "))
+	}
+	return nil
+}
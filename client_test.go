@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogCommand(t *testing.T) {
+	rpcTestServer(t)
+	if err := logCommand("info", []string{"hello", "k=v"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"loud", "hello"},
+		{"info"},
+		{"info", "hello", "novalue"},
+	} {
+		if err := logCommand(args[0], args[1:]); err == nil {
+			t.Errorf("logCommand(%q) succeeded", args)
+		}
+	}
+}
+
+func TestLockCommand(t *testing.T) {
+	rpcTestServer(t)
+	holder, err := rpcDial(baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	req := &LockReq{Name: "test"}
+	if err := rpcCall(holder, "RpcSrv.Lock", req, &LockRes{}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- lockCommand("test", []string{"true"}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("lockCommand ran while lock was held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := rpcCall(holder, "RpcSrv.Unlock", req, &LockRes{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lockCommand did not run after unlock")
+	}
+	if err := lockCommand("test", []string{"false"}); err == nil {
+		t.Error("lockCommand with failing command succeeded")
+	}
+	if err := lockCommand("../test", []string{"true"}); err == nil {
+		t.Error("lockCommand with bad name succeeded")
+	}
+}
+
+func TestUnlockHandshake(t *testing.T) {
+	rpcTestServer(t)
+	client := rpcTestConn(t)
+	err := rpcCall(client, "RpcSrv.Unlock", &LockReq{Name: "test"},
+		&LockRes{})
+	if !errors.Is(err, errRpcHandshake) {
+		t.Fatalf("Unlock = %v, want RpcErrHandshake", err)
+	}
+}
+
+func TestOnExitCommand(t *testing.T) {
+	rpcTestServer(t)
+	file := filepath.Join(t.TempDir(), "cleaned")
+	if err := onExitCommand([]string{"touch", file}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Fatal("cleanup ran before exit")
+	}
+	defers.run()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("cleanup did not run: %v", err)
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	dir := rpcTestServer(t)
+	script := filepath.Join(dir, ".run", "hello")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	client, err := rpcDial(baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var res ResolveRes
+	err = rpcCall(client, "RpcSrv.ResolveCommand",
+		&ResolveReq{Argv: []string{"hello"}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Path != script {
+		t.Errorf("ResolveCommand(hello) = %q, want %q", res.Path, script)
+	}
+	err = rpcCall(client, "RpcSrv.ResolveCommand",
+		&ResolveReq{Argv: []string{"nope"}}, &res)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ResolveCommand(nope) = %v, want not exist", err)
+	}
+	if err := resolveCommand([]string{"hello"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockTwice(t *testing.T) {
+	rpcTestServer(t)
+	client, err := rpcDial(baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			errs <- rpcCall(client, "RpcSrv.Lock", &LockReq{Name: "twice"},
+				&LockRes{})
+		}()
+	}
+	var failed int
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				failed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock waited on its own connection's lock")
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d of 2 Locks of one name failed, want 1", failed)
+	}
+}
+
+func TestClientNotNested(t *testing.T) {
+	t.Setenv("RUNRPC", "")
+	for name, fn := range map[string]func() error{
+		"log":     func() error { return logCommand("info", []string{"hi"}) },
+		"lock":    func() error { return lockCommand("x", []string{"true"}) },
+		"on-exit": func() error { return onExitCommand([]string{"true"}) },
+		"resolve": func() error { return resolveCommand([]string{"x"}) },
+	} {
+		if err := fn(); !errors.Is(err, errNotNested) {
+			t.Errorf("--%s = %v, want errNotNested", name, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os/exec"
+
+	"github.com/google/shlex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// command is a command that run can execute: either an executable file in
+// a .run directory, or a command line registered by init.lua.
+type command struct {
+	name string
+	path string   // Executable file, for file-based commands.
+	argv []string // Command line, for commands registered by init.lua.
+	desc string
+	env  map[string]string
+	ctr  string
+
+	incwd  bool // Run in the caller's working directory, not the root.
+	params []param
+}
+
+func (c *command) cmd(args []string) *exec.Cmd {
+	if c.path != "" {
+		return exec.Command(c.path, args...)
+	}
+	argv := append(append([]string{}, c.argv[1:]...), args...)
+	return exec.Command(c.argv[0], argv...)
+}
+
+// command returns the command registered by e's init.lua under name, if any.
+func (e *runEnv) command(name string) *command {
+	for _, cmd := range e.commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// luaCommand implements run.command{name=..., cmd={...}, desc=..., env={...},
+// ctr=..., cwd=..., flags={...}, args={...}}.
+func luaCommand(L *lua.LState, env *runEnv) int {
+	t := L.CheckTable(1)
+	cmd := &command{env: make(map[string]string)}
+	if name, ok := t.RawGetString("name").(lua.LString); ok {
+		cmd.name = string(name)
+	} else {
+		L.ArgError(1, "command needs a name")
+	}
+	switch v := t.RawGetString("cmd").(type) {
+	case lua.LString:
+		argv, err := shlex.Split(string(v))
+		if err != nil {
+			L.ArgError(1, "bad cmd for '"+cmd.name+"': "+err.Error())
+		}
+		cmd.argv = argv
+	case *lua.LTable:
+		v.ForEach(func(_, arg lua.LValue) {
+			cmd.argv = append(cmd.argv, arg.String())
+		})
+	}
+	if len(cmd.argv) < 1 {
+		L.ArgError(1, "command '"+cmd.name+"' needs a cmd")
+	}
+	if desc, ok := t.RawGetString("desc").(lua.LString); ok {
+		cmd.desc = string(desc)
+	}
+	if ctr, ok := t.RawGetString("ctr").(lua.LString); ok {
+		cmd.ctr = string(ctr)
+	}
+	cmd.incwd = lua.LVAsBool(t.RawGetString("cwd"))
+	if envt, ok := t.RawGetString("env").(*lua.LTable); ok {
+		envt.ForEach(func(k, v lua.LValue) {
+			cmd.env[k.String()] = v.String()
+		})
+	}
+	cmd.params = luaParams(L, t)
+	if old := env.command(cmd.name); old != nil {
+		*old = *cmd
+	} else {
+		env.commands = append(env.commands, cmd)
+	}
+	return 0
+}
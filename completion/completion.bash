@@ -1,13 +1,26 @@
 #!/usr/bin/env bash
 
 __run_completion () {
-    case "${COMP_WORDS[COMP_CWORD]}" in
-        -*) suggestions="-i -r -l"
-            ;;
-        *)
-            suggestions="$(run -l)"
-            ;;
-    esac
+    local cmd i
+    for (( i=1; i < COMP_CWORD; i++ ))
+    do
+        case "${COMP_WORDS[i]}" in
+            -*) ;;
+            *) cmd="${COMP_WORDS[i]}"; break ;;
+        esac
+    done
+    if [ -n "$cmd" ]
+    then
+        suggestions="$(run --complete "$cmd" 2>/dev/null)"
+    else
+        case "${COMP_WORDS[COMP_CWORD]}" in
+            -*) suggestions="-i -r -l -h"
+                ;;
+            *)
+                suggestions="$(run -l)"
+                ;;
+        esac
+    fi
     [ -z "$suggestions" ] && return 0
     COMPREPLY=()
     while read -r suggestion
@@ -33,29 +33,33 @@ func containerCleanup() {
 	}
 }
 
-func containerSetup() (string, error) {
+func containerSetup() (string, string, error) {
 	if err := ctrctlSetup(); err != nil {
-		return "", err
+		return "", "", err
+	}
+	rpc, err := rpcContainer()
+	if err != nil {
+		return "", "", err
 	}
 	image := os.Getenv("RUNCTR")
 	if len(image) > 0 && (image[0] == '/' || image[0] == '.') {
-		var err error
 		if image, err = buildContainer(image); err != nil {
-			return "", err
+			return "", "", err
 		}
 	}
 	container, err := ctrctl.ContainerRun(
 		&ctrctl.ContainerRunOpts{
+			AddHost: rpc.host,
 			Detach:  true,
 			Tty:     true,
-			Volume:  []string{root + ":/work"},
+			Volume:  append([]string{root + ":/work"}, rpc.volume...),
 			Workdir: "/work",
 		},
 		image,
 		"cat",
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to start container: %s", err)
+		return "", "", fmt.Errorf("failed to start container: %s", err)
 	}
 	containers = append(containers, container)
 	imageid, err := ctrctl.Inspect(
@@ -63,30 +67,33 @@ func containerSetup() (string, error) {
 		container,
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to get image id of work container: %s",
-			err)
+		return "", "", fmt.Errorf(
+			"failed to get image id of work container: %s", err)
 	}
 	osarch, err := ctrctl.Inspect(
 		&ctrctl.InspectOpts{Format: "{{.Os}}/{{.Architecture}}"},
 		imageid,
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to get os/arch of work container: %s",
-			err)
+		return "", "", fmt.Errorf(
+			"failed to get os/arch of work container: %s", err)
 	}
 	ctros, ctrarch, ok := strings.Cut(osarch, "/")
 	if !ok {
-		return "", fmt.Errorf("failed to parse os/arch format: %s", err)
+		return "", "", fmt.Errorf("failed to parse os/arch format: %s", err)
 	}
 	if err = installRunInContainer(container, ctros, ctrarch); err != nil {
-		return "", err
+		return "", "", err
 	}
 	if runtime.GOOS == "linux" {
 		if err = fixFileOwners(container); err != nil {
-			return "", err
+			return "", "", err
+		}
+		if err = rpcShare(cuid); err != nil {
+			return "", "", err
 		}
 	}
-	return container, nil
+	return container, rpc.addr, nil
 }
 
 func ctrctlSetup() error {
@@ -171,8 +178,8 @@ func fixFileOwners(ctr string) error {
 			return fmt.Errorf("non-numeric user id: %s", user)
 		}
 	}
-	if ouid, ogid, err = getOwner(".git"); err != nil {
-		return fmt.Errorf("failed to get owner of .git directory: %s", err)
+	if ouid, ogid, err = getOwner("."); err != nil {
+		return fmt.Errorf("failed to get owner of project root: %s", err)
 	}
 	dorestore = true
 	return containerChown(ouid, ogid, cuid, cuid)
@@ -1,13 +1,117 @@
 package main
 
-type deferlist []func()
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+type deferlist struct {
+	mu    sync.Mutex
+	funcs []func()
+}
 
 func (d *deferlist) add(f func()) {
-	*d = append(deferlist{f}, *d...)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcs = append([]func(){f}, d.funcs...)
 }
 
 func (d *deferlist) run() {
-	for _, f := range *d {
+	d.mu.Lock()
+	funcs := d.funcs
+	d.funcs = nil
+	d.mu.Unlock()
+	for _, f := range funcs {
 		f()
 	}
 }
+
+var exitOnce sync.Once
+
+// exit runs the deferred functions and exits with code. Only the first call
+// does so; later calls, say from an interrupt while the after hooks run,
+// block until the process exits.
+func exit(code int) {
+	exitOnce.Do(func() {
+		defers.run()
+		os.Exit(code)
+	})
+	select {}
+}
+
+// waiting tracks the commands run is waiting on. An interrupt also reaches
+// them, so the first interrupt is left to the commands, and run runs its
+// deferred functions once they are done. A second interrupt kills them and
+// exits, for commands that ignore interrupts or do not get them, as in
+// containers.
+var waiting struct {
+	sync.Mutex
+	procs       map[*os.Process]bool
+	n           int
+	interrupted bool
+	exiting     bool
+	idle        chan struct{} // Closed when exiting and no longer waiting.
+}
+
+var errInterrupted = errors.New("interrupted")
+
+// waitStart marks the start of a wait on a command, whose process is p if
+// run started it. It fails if run is already exiting.
+func waitStart(p *os.Process) error {
+	waiting.Lock()
+	defer waiting.Unlock()
+	if waiting.exiting {
+		return errInterrupted
+	}
+	waiting.n++
+	if p != nil {
+		if waiting.procs == nil {
+			waiting.procs = make(map[*os.Process]bool)
+		}
+		waiting.procs[p] = true
+	}
+	return nil
+}
+
+// waitDone marks the end of a wait started by waitStart.
+func waitDone(p *os.Process) {
+	waiting.Lock()
+	defer waiting.Unlock()
+	waiting.n--
+	delete(waiting.procs, p)
+	if waiting.exiting && waiting.n == 0 {
+		close(waiting.idle)
+	}
+}
+
+// handleSignals exits on interrupt, unless run is waiting on a command and
+// has not been interrupted before.
+func handleSignals(sig <-chan os.Signal) {
+	for range sig {
+		waiting.Lock()
+		if waiting.n > 0 && !waiting.interrupted {
+			waiting.interrupted = true
+			waiting.Unlock()
+			continue
+		}
+		waiting.exiting = true
+		waiting.idle = make(chan struct{})
+		if waiting.n == 0 {
+			close(waiting.idle)
+		}
+		for p := range waiting.procs {
+			_ = p.Kill()
+		}
+		waiting.Unlock()
+		// Let the killed commands be reaped, so that after hooks see their
+		// exit status. Commands in containers are removed by deferred
+		// functions instead.
+		select {
+		case <-waiting.idle:
+		case <-time.After(time.Second):
+		}
+		exit(1)
+	}
+}
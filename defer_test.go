@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deferTestChild runs the test named by RUNTESTDEFER in a child process,
+// as exit ends the process, and returns its exit code and output.
+func deferTestChild(t *testing.T) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$")
+	cmd.Env = append(os.Environ(), "RUNTESTDEFER="+t.Name())
+	out, err := cmd.Output()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		t.Fatal(err)
+	}
+	return cmd.ProcessState.ExitCode(), string(out)
+}
+
+func TestExitOnce(t *testing.T) {
+	if os.Getenv("RUNTESTDEFER") == t.Name() {
+		defers.add(func() {
+			fmt.Println("deferred")
+			go exit(2) // Blocks, as the first exit is running.
+			time.Sleep(50 * time.Millisecond)
+		})
+		exit(3)
+	}
+	code, out := deferTestChild(t)
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if n := strings.Count(out, "deferred"); n != 1 {
+		t.Errorf("deferred functions ran %d times, want 1:\n%s", n, out)
+	}
+}
+
+func TestSignalTwice(t *testing.T) {
+	if os.Getenv("RUNTESTDEFER") == t.Name() {
+		sig := make(chan os.Signal)
+		go handleSignals(sig)
+		defers.add(func() { fmt.Println("deferred") })
+		// The command ignores interrupts, as a trapping shell would.
+		cmd := exec.Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitStart(cmd.Process); err != nil {
+			t.Fatal(err)
+		}
+		sig <- os.Interrupt
+		time.Sleep(50 * time.Millisecond)
+		fmt.Println("waiting")
+		sig <- os.Interrupt
+		_ = cmd.Wait()
+		waitDone(cmd.Process)
+		select {}
+	}
+	start := time.Now()
+	code, out := deferTestChild(t)
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if out != "waiting\ndeferred\n" {
+		t.Errorf("output = %q, want waiting after the first interrupt "+
+			"and deferred after the second", out)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("exit took %s, want the command killed", d)
+	}
+}
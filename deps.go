@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkImports calls fn for each package imported by env, depth first.
+// Packages that were already visited are passed with seen set
+// and not descended into.
+func walkImports(env *runEnv,
+	fn func(depth int, from *runEnv, imp pkgImport, seen bool)) error {
+	seen := map[string]bool{env.path: true}
+	var walk func(*runEnv, int) error
+	walk = func(e *runEnv, depth int) error {
+		if err := e.Init(); err != nil {
+			return err
+		}
+		for _, imp := range e.imports {
+			fn(depth, e, imp, seen[imp.path])
+			if seen[imp.path] {
+				continue
+			}
+			seen[imp.path] = true
+			if err := walk(e.Child(imp.path), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(env, 0)
+}
+
+// pkgRev returns the locked revision of an imported package.
+func pkgRev(env *runEnv, imp pkgImport) string {
+	if rev := env.locks[imp.url]; rev != "" {
+		return rev
+	} else if env.root != nil && env.root.locks[imp.url] != "" {
+		return env.root.locks[imp.url]
+	}
+	bysrc, err := cacheDir("store", "by-src")
+	if err != nil {
+		return ""
+	}
+	entries, err := os.ReadDir(bysrc)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		path, err := filepath.EvalSymlinks(filepath.Join(bysrc, e.Name()))
+		if err == nil && filepath.Base(path) == filepath.Base(imp.path) {
+			rev, _, _ := strings.Cut(e.Name(), "@")
+			return rev
+		}
+	}
+	return ""
+}
+
+func initScript(env *runEnv) string {
+	return filepath.Join(env.path, ".run", "init.lua")
+}
+
+func printDeps(env *runEnv) error {
+	fmt.Println(env.path)
+	return walkImports(env,
+		func(depth int, from *runEnv, imp pkgImport, seen bool) {
+			indent := strings.Repeat("  ", depth+1)
+			rev := pkgRev(from, imp)
+			if rev == "" {
+				rev = "<unlocked>"
+			}
+			fmt.Printf("%s%s %s %s (%s)", indent, imp.url, rev,
+				filepath.Base(imp.path), initScript(from))
+			if seen {
+				fmt.Print(" (listed above)")
+			}
+			fmt.Println()
+		},
+	)
+}
+
+func whyCommand(name string) error {
+	e := baseEnv()
+	e.argv = []string{name}
+	cmd, found, err := lookCommand(e)
+	if errors.Is(err, errBadCmd) {
+		return fmt.Errorf("command not found: %s", name)
+	} else if err != nil {
+		return err
+	}
+	return printOrigin(name, cmd, found)
+}
+
+// printOrigin prints where the command cmd, found in env found, comes from.
+func printOrigin(name string, cmd *command, found *runEnv) error {
+	var dir string
+	if cmd.path != "" {
+		fmt.Printf("%s: %s\n", name, cmd.path)
+		dir = filepath.Dir(filepath.Dir(cmd.path))
+	} else {
+		fmt.Printf("%s: %s (%s)\n", name, strings.Join(cmd.argv, " "),
+			initScript(found))
+		dir = found.path
+	}
+	if dir == root {
+		fmt.Println("  from project root")
+	} else if rel, err := filepath.Rel(root, dir); err == nil &&
+		!strings.HasPrefix(rel, "..") && !strings.HasPrefix(rel, ".run") {
+		fmt.Printf("  from project directory %s\n", rel)
+	} else {
+		var origin *pkgImport
+		var importer string
+		err := walkImports(baseEnv(),
+			func(_ int, from *runEnv, imp pkgImport, _ bool) {
+				if origin == nil && imp.path == dir {
+					origin, importer = &imp, initScript(from)
+				}
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if origin != nil {
+			fmt.Printf("  from package %s (%s)\n", origin.url,
+				filepath.Base(dir))
+			fmt.Printf("  imported by %s\n", importer)
+		} else {
+			fmt.Printf("  from RUNPATH entry %s\n", dir)
+		}
+	}
+	if pkgs := found.env["RUNPKGS"]; pkgs != "" {
+		fmt.Printf("  in context of %s\n", pkgs)
+	}
+	return nil
+}
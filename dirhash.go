@@ -16,12 +16,19 @@ import (
 
 type hashfn func(files []string, fullpath func(string) string) (string, error)
 
-// hashDir hashes the contents of path.
+// hash1 hashes files, as listed by dirhash.DirFiles.
 // The output of this function should be equivalent to:
 //
-//	for f in $(find . -type f | sort | cut -c 3-)
+//	for f in $(find . -type f -o -type l | sort | cut -c 3-)
 //	do
-//	    if [ -x "$f" ]
+//	    if [ -L "$f" ]
+//	    then
+//	        printf "@ "
+//	        printf "%s  %s\n" \
+//	            "$(printf %s "$(readlink "$f")" | sha256sum | cut -c -64)" \
+//	            "$f"
+//	        continue
+//	    elif [ -x "$f" ]
 //	    then
 //	        printf "+ "
 //	    else
@@ -29,6 +36,10 @@ type hashfn func(files []string, fullpath func(string) string) (string, error)
 //	    fi
 //	    sha256sum "$f"
 //	done | sha256sum
+//
+// Symlinks are hashed by their target rather than followed, so a link to a
+// directory can be hashed and a link is not mistaken for a copy of its
+// target.
 func hash1(files []string, path func(string) string) (string, error) {
 	h := sha256.New()
 	files = append([]string{}, files...)
@@ -37,27 +48,44 @@ func hash1(files []string, path func(string) string) (string, error) {
 		if strings.Contains(file, "\n") {
 			return "", errors.New("files with newlines are not allowed")
 		}
-		r, err := os.Open(path(file))
-		if err != nil {
-			return "", err
-		}
-		hf := sha256.New()
-		_, err = io.Copy(hf, r)
-		r.Close()
+		mode, sum, err := hashFile(path(file))
 		if err != nil {
 			return "", err
 		}
-		info, err := os.Stat(path(file))
+		fmt.Fprintf(h, "%c %x  %s\n", mode, sum, file)
+	}
+	return "h1_" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the mode character and content hash of a hash1 entry.
+func hashFile(name string) (rune, []byte, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	hf := sha256.New()
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
 		if err != nil {
-			return "", err
-		}
-		exec := ' '
-		if info.Mode()&0111 != 0 {
-			exec = '+'
+			return 0, nil, err
 		}
-		fmt.Fprintf(h, "%c %x  %s\n", exec, hf.Sum(nil), file)
+		hf.Write([]byte(filepath.ToSlash(target)))
+		return '@', hf.Sum(nil), nil
 	}
-	return "h1_" + hex.EncodeToString(h.Sum(nil)), nil
+	r, err := os.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = io.Copy(hf, r)
+	r.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	mode := ' '
+	if info.Mode()&0111 != 0 {
+		mode = '+'
+	}
+	return mode, hf.Sum(nil), nil
 }
 
 func hashDir(dir, prefix string, hash hashfn) (string, error) {
@@ -4,19 +4,31 @@ import (
 	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
 type runEnv struct {
 	inited bool
 
-	env   map[string]string
-	argv  []string
-	locks map[string]string
+	env     map[string]string
+	argv    []string
+	locks   map[string]string
+	lockids map[string]string
 
-	root *runEnv
+	root     *runEnv
+	path     string
+	id       string
+	imports  []pkgImport
+	commands []*command
+	hooks    []hook
+	layers   []*runEnv
+}
+
+// pkgImport records a package imported by an environment's init.lua.
+type pkgImport struct {
+	url  string
 	path string
-	id   string
 }
 
 func (e *runEnv) Clone() *runEnv {
@@ -27,10 +39,9 @@ func (e *runEnv) Clone() *runEnv {
 	for k, v := range e.env {
 		o.env[k] = v
 	}
-	o.locks = make(map[string]string)
-	for k, v := range e.locks {
-		o.locks[k] = v
-	}
+	o.locks = maps.Clone(e.locks)
+	o.lockids = maps.Clone(e.lockids)
+	o.hooks = slices.Clone(e.hooks)
 	if e.root == nil {
 		o.root = e
 	} else {
@@ -39,6 +50,63 @@ func (e *runEnv) Clone() *runEnv {
 	return o
 }
 
+// Layers returns the environments of the project's .run directories, from
+// the root down to the one nearest the working directory. Each layer starts
+// from the environment left by the init.lua of the layer above it.
+// Environments other than the project root have only themselves as a layer.
+func (e *runEnv) Layers() ([]*runEnv, error) {
+	if e.layers != nil {
+		return e.layers, nil
+	}
+	if err := e.Init(); err != nil {
+		return nil, err
+	}
+	layers := []*runEnv{e}
+	if e.path == root && e.root == nil {
+		for _, dir := range layerDirs() {
+			l := layers[len(layers)-1].Clone()
+			l.path = dir
+			if err := l.Init(); err != nil {
+				return nil, err
+			}
+			layers = append(layers, l)
+		}
+	}
+	e.layers = layers
+	return layers, nil
+}
+
+// layerDirs lists the directories with a .run directory between the root
+// and the working directory run was started in, top down.
+func layerDirs() (dirs []string) {
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Stat(filepath.Join(dir, ".run"))
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	return
+}
+
+// Child returns a clone of e for the package at path on e's RUNPATH.
+func (e *runEnv) Child(path string) *runEnv {
+	o := e.Clone()
+	delete(o.env, "RUNPATH")
+	o.path = path
+	if e.Id() != "" && o.env["RUNPKGS"] != "" {
+		o.env["RUNPKGS"] = o.env["RUNPKGS"] + ":" + e.Id()
+	} else if e.Id() != "" {
+		o.env["RUNPKGS"] = e.Id()
+	}
+	return o
+}
+
 // lpenv returns a copy of e.env that is compatible with lookpath.
 func (e *runEnv) lpenv() map[string]string {
 	m := make(map[string]string)
@@ -73,7 +141,8 @@ func (e *runEnv) Id() string {
 	if err != nil {
 		return ""
 	}
-	if strings.HasPrefix(abs, store) {
+	if strings.HasPrefix(abs, store) ||
+		filepath.Dir(abs) == filepath.Join(root, ".run", "vendor") {
 		e.id = filepath.Base(abs)
 		return e.id
 	} else {
@@ -103,8 +172,9 @@ func setenv(env map[string]string) {
 
 func baseEnv() *runEnv {
 	return &runEnv{
-		env:   envmap(),
-		locks: make(map[string]string),
-		path:  root,
+		env:     envmap(),
+		locks:   make(map[string]string),
+		lockids: make(map[string]string),
+		path:    root,
 	}
 }
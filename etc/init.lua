@@ -0,0 +1,7 @@
+-- init.lua runs before every command. See lesiw.io/run.
+--
+-- Import commands from another project:
+-- run.import("lesiw.io/example")
+--
+-- Register a command without writing a script:
+-- run.command{name="hello", cmd={"echo", "hello"}, desc="Say hello"}
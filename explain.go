@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// unfetched lists the imports that --explain found neither vendored nor in
+// the store, and so would be fetched and built.
+var unfetched []string
+
+// explainPackage returns the path of the locked, already built package at
+// url without fetching or building anything, or "" if it is not built.
+func explainPackage(env *runEnv, url string) (string, error) {
+	rev, id := env.locks[url], env.lockids[url]
+	if id != "" && rev != "" {
+		if path, ok, err := vendored(id); err != nil || ok {
+			return path, err
+		}
+	}
+	if rev != "" {
+		path, err := storeByRev(rev, hostPlatform)
+		if err != nil || path != "" {
+			return path, err
+		}
+	}
+	if !slices.Contains(unfetched, url) {
+		unfetched = append(unfetched, url)
+	}
+	return "", nil
+}
+
+// explainUnfetched explains a command that was not found, but may come from
+// a package that is not yet built.
+func explainUnfetched(argv []string) error {
+	fmt.Println("argv:", strings.Join(append([]string{"run"}, argv...), " "))
+	fmt.Println("origin: not found in built packages")
+	for _, url := range unfetched {
+		fmt.Println("would fetch:", url)
+	}
+	return nil
+}
+
+// explainCommand prints what execCommand would do to run cmd, without
+// running it or starting any containers. before is the environment run was
+// started with.
+func explainCommand(e *runEnv, cmd *command, found *runEnv, args []string,
+	before map[string]string) error {
+	fmt.Println("argv:", strings.Join(append([]string{"run"},
+		append([]string{e.argv[0]}, args...)...), " "))
+	if err := printOrigin(e.argv[0], cmd, found); err != nil {
+		return err
+	}
+	if cmd.argv != nil {
+		fmt.Println("exec:", strings.Join(append(
+			append([]string{}, cmd.argv...), args...), " "))
+	} else {
+		fmt.Println("exec:", strings.Join(append(
+			[]string{cmd.path}, args...), " "))
+	}
+	if cmd.incwd {
+		fmt.Println("dir:", cwd)
+	} else {
+		fmt.Println("dir:", root)
+	}
+	for _, url := range unfetched {
+		fmt.Println("would fetch:", url)
+	}
+	explainContainer()
+	explainHooks(e)
+	explainEnv(before, envmap())
+	return nil
+}
+
+func explainContainer() {
+	image := os.Getenv("RUNCTR")
+	switch {
+	case os.Getenv("RUNCTRID") != "":
+		fmt.Println("container: already in container",
+			os.Getenv("RUNCTRID"))
+	case image == "":
+		fmt.Println("container: none")
+	case image[0] == '/' || image[0] == '.':
+		fmt.Println("container: image built from", image)
+	default:
+		fmt.Println("container: image", image)
+	}
+}
+
+func explainHooks(e *runEnv) {
+	if os.Getenv("RUNCTRID") != "" || os.Getenv("RUNHOOK") != "" {
+		return
+	}
+	counts := make(map[string]int)
+	for _, h := range e.hooks {
+		counts[h.when]++
+	}
+	for _, when := range []string{"before", "after", "failure"} {
+		if counts[when] > 0 {
+			fmt.Printf("hooks: %d %s\n", counts[when], when)
+		}
+	}
+}
+
+// explainEnv prints the variables that differ between before and after.
+func explainEnv(before, after map[string]string) {
+	var keys []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok || old != v {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) < 1 {
+		fmt.Println("env: unchanged")
+		return
+	}
+	slices.Sort(keys)
+	fmt.Println("env:")
+	for _, k := range keys {
+		if old, ok := before[k]; ok {
+			fmt.Printf("  %s=%s (was %s)\n", k, after[k], old)
+		} else {
+			fmt.Printf("  %s=%s\n", k, after[k])
+		}
+	}
+}
@@ -66,20 +66,26 @@ func downloadUrl(url, path string) error {
 			resp.StatusCode)
 	}
 
-	out, err := os.Create(path)
+	out, err := os.CreateTemp(filepath.Dir(path), ".download")
 	if err != nil {
 		return fmt.Errorf("failed to create file '%s': %s", path, err)
 	}
+	defer os.Remove(out.Name())
 	defer out.Close()
 
 	_, err = io.Copy(out, resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to download to '%s': %s", path, err)
 	}
-
-	if err = os.Chmod(path, 0755); err != nil {
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("failed to download to '%s': %s", path, err)
+	}
+	if err = os.Chmod(out.Name(), 0755); err != nil {
 		return fmt.Errorf("failed to mark '%s' as executable: %s", path, err)
 	}
+	if err = os.Rename(out.Name(), path); err != nil {
+		return fmt.Errorf("failed to move download to '%s': %s", path, err)
+	}
 
 	return nil
 }
@@ -15,4 +15,4 @@ require (
 	v.io/x/lib v0.1.20
 )
 
-require golang.org/x/sys v0.19.0 // indirect
+require golang.org/x/sys v0.19.0
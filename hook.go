@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// hook is a Lua function or command line that init.lua registered to run
+// around commands.
+type hook struct {
+	when string // One of before, after, or failure.
+	fn   *lua.LFunction
+	argv []string
+	L    *lua.LState // The state fn belongs to.
+}
+
+// hookEvent describes the command a hook runs around.
+type hookEvent struct {
+	name     string
+	args     []string
+	duration time.Duration
+	status   int // -1 if the command was interrupted or did not start.
+}
+
+// luaHook implements run.before, run.after, and run.onfailure.
+// Each takes a function, which is passed an event table, or a command line.
+func luaHook(L *lua.LState, env *runEnv, when string) int {
+	h := hook{when: when, L: L}
+	switch v := L.CheckAny(1).(type) {
+	case *lua.LFunction:
+		h.fn = v
+	case lua.LString:
+		argv, err := shlex.Split(string(v))
+		if err != nil {
+			L.ArgError(1, "bad hook: "+err.Error())
+		}
+		h.argv = argv
+	case *lua.LTable:
+		v.ForEach(func(_, arg lua.LValue) {
+			h.argv = append(h.argv, arg.String())
+		})
+	}
+	if h.fn == nil && len(h.argv) < 1 {
+		L.ArgError(1, "hook must be a function or a command")
+	}
+	env.hooks = append(env.hooks, h)
+	return 0
+}
+
+// runHooks runs env's hooks for when. Hooks of nested run invocations
+// started by hooks are skipped, so that hooks cannot recurse.
+func runHooks(env *runEnv, when string, ev *hookEvent) error {
+	if os.Getenv("RUNHOOK") != "" {
+		return nil
+	}
+	for _, h := range env.hooks {
+		if h.when != when {
+			continue
+		}
+		var err error
+		if h.fn != nil {
+			if err = h.call(ev); err != nil {
+				err = newLuaError(env, err)
+			}
+		} else {
+			err = h.exec(ev)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook failed: %w", when, err)
+		}
+	}
+	return nil
+}
+
+func (h hook) call(ev *hookEvent) error {
+	L := h.L
+	t, args := L.NewTable(), L.NewTable()
+	for _, arg := range ev.args {
+		args.Append(lua.LString(arg))
+	}
+	L.SetField(t, "name", lua.LString(ev.name))
+	L.SetField(t, "args", args)
+	if h.when != "before" {
+		L.SetField(t, "duration", lua.LNumber(ev.duration.Seconds()))
+		L.SetField(t, "status", lua.LNumber(ev.status))
+	}
+	return L.CallByParam(lua.P{Fn: h.fn, NRet: 0, Protect: true}, t)
+}
+
+// exec runs a command hook. The event is passed in RUNHOOK* variables.
+func (h hook) exec(ev *hookEvent) error {
+	cmd := exec.Command(h.argv[0], h.argv[1:]...)
+	cmd.Env = append(os.Environ(),
+		"RUNHOOK="+h.when,
+		"RUNHOOKCMD="+ev.name,
+		"RUNHOOKARGS="+strings.Join(ev.args, " "),
+	)
+	if h.when != "before" {
+		cmd.Env = append(cmd.Env,
+			"RUNHOOKDURATION="+
+				strconv.FormatFloat(ev.duration.Seconds(), 'f', -1, 64),
+			"RUNHOOKSTATUS="+strconv.Itoa(ev.status),
+		)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// exitStatus returns the exit status of a command that returned err.
+func exitStatus(err error) int {
+	var ee *exec.ExitError
+	if err == nil {
+		return 0
+	} else if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
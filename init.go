@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -22,7 +26,20 @@ func (env *runEnv) Init() error {
 		return nil
 	}
 	L := lua.NewState(lua.Options{SkipOpenLibs: true})
-	defer L.Close()
+	nhooks := len(env.hooks)
+	defer func() {
+		if len(env.hooks) > nhooks {
+			defers.add(L.Close) // Kept open for hooks.
+		} else {
+			L.Close()
+		}
+	}()
+	luaOpenLibs(L)
+	mt := L.NewTypeMetatable(luaCauseType)
+	L.SetField(mt, "__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(luaCauseOf(L.Get(1)).Error()))
+		return 1
+	}))
 
 	cfg, argt, envt := L.NewTable(), L.NewTable(), L.NewTable()
 	for _, arg := range env.argv {
@@ -34,12 +51,23 @@ func (env *runEnv) Init() error {
 	}
 	L.SetField(cfg, "env", envt)
 	L.SetField(cfg, "import", L.NewFunction(func(L *lua.LState) int {
-		return luaImport(L, env)
+		return luaImport(L, env, envt)
+	}))
+	L.SetField(cfg, "command", L.NewFunction(func(L *lua.LState) int {
+		return luaCommand(L, env)
 	}))
+	for name, when := range map[string]string{
+		"before": "before", "after": "after", "onfailure": "failure",
+	} {
+		L.SetField(cfg, name, L.NewFunction(func(L *lua.LState) int {
+			return luaHook(L, env, when)
+		}))
+	}
+	luaRunLib(L, cfg, env)
 	L.SetGlobal("run", cfg)
 
 	if err := L.DoFile(script); err != nil {
-		return fmt.Errorf("failed to run init.lua: %s", err)
+		return newLuaError(env, err)
 	}
 
 	env.argv = []string{}
@@ -53,10 +81,221 @@ func (env *runEnv) Init() error {
 	return nil
 }
 
-func luaImport(L *lua.LState, env *runEnv) int {
+func luaImport(L *lua.LState, env *runEnv, envt *lua.LTable) int {
 	url := L.CheckString(1)
 	if err := importPackage(env, url); err != nil {
-		L.RaiseError("failed to import package '%s': %s", url, err)
+		luaRaise(L, fmt.Errorf("failed to import package '%s': %w", url, err))
 	}
+	// run.env replaces env.env once init.lua returns, so the RUNPATH entry
+	// added by the import must be written back to it or it is lost.
+	L.SetField(envt, "RUNPATH", lua.LString(env.env["RUNPATH"]))
 	return 0
 }
+
+// luaError is an error raised while running an init.lua script.
+type luaError struct {
+	script string
+	id     string // Package id, if the script belongs to a package.
+	msg    string
+	trace  string
+	cause  error
+}
+
+func (e *luaError) Error() string {
+	var b strings.Builder
+	b.WriteString("failed to run init.lua")
+	if e.id != "" {
+		b.WriteString(" of package " + e.id)
+	}
+	b.WriteString(": " + e.msg)
+	if !strings.Contains(e.msg, e.script) {
+		b.WriteString(" (" + e.script + ")")
+	}
+	if e.trace != "" {
+		b.WriteString("\n" + e.trace)
+	}
+	return b.String()
+}
+
+func (e *luaError) Unwrap() error { return e.cause }
+
+func newLuaError(env *runEnv, err error) error {
+	lerr := &luaError{
+		script: initScript(env),
+		id:     env.Id(),
+		msg:    strings.TrimSpace(err.Error()),
+		cause:  err,
+	}
+	var apierr *lua.ApiError
+	if errors.As(err, &apierr) {
+		lerr.msg = strings.TrimSpace(apierr.Object.String())
+		lerr.trace = apierr.StackTrace
+		if cause := luaCauseOf(apierr.Object); cause != nil {
+			lerr.msg, lerr.cause = cause.Error(), cause
+		} else {
+			lerr.cause = apierr.Cause
+		}
+	}
+	return lerr
+}
+
+// luaCause carries a Go error through Lua, so that errors.Is works on
+// errors raised by Go functions called from init.lua.
+type luaCause struct {
+	where string
+	err   error
+}
+
+func (c *luaCause) Error() string {
+	return strings.TrimSpace(c.where + " " + c.err.Error())
+}
+
+func (c *luaCause) Unwrap() error { return c.err }
+
+const luaCauseType = "error"
+
+// luaRaise raises err as a Lua error.
+func luaRaise(L *lua.LState, err error) {
+	ud := L.NewUserData()
+	var where string
+	for level := 1; ; level++ {
+		where = L.Where(level)
+		if where == "" || !strings.HasPrefix(where, "[G]") {
+			break
+		}
+	}
+	ud.Value = &luaCause{where: where, err: err}
+	L.SetMetatable(ud, L.GetTypeMetatable(luaCauseType))
+	L.Error(ud, 0)
+}
+
+func luaCauseOf(v lua.LValue) *luaCause {
+	if ud, ok := v.(*lua.LUserData); ok {
+		if cause, ok := ud.Value.(*luaCause); ok {
+			return cause
+		}
+	}
+	return nil
+}
+
+// luaUnsafe lists the base functions that would let init.lua load code or
+// reach outside of the sandbox.
+var luaUnsafe = []string{
+	"collectgarbage", "dofile", "getfenv", "load", "loadfile", "loadstring",
+	"module", "newproxy", "require", "setfenv", "_printregs",
+}
+
+func luaOpenLibs(L *lua.LState) {
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.StringLibName: lua.OpenString,
+		lua.TabLibName:    lua.OpenTable,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range luaUnsafe {
+		L.SetGlobal(name, lua.LNil)
+	}
+}
+
+var errOutside = errors.New("path is outside of the package")
+
+// luaConfine resolves path against the package root and fails if it, or
+// the file it links to, is outside of the root. A path that does not exist
+// is only checked as written.
+func luaConfine(root, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	check := func(root, path string) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%w: %s", errOutside, path)
+		}
+		return nil
+	}
+	if err := check(root, filepath.Clean(path)); err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path, nil
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	return real, check(root, real)
+}
+
+// luaRunLib adds helpers to the run table. Paths are relative to the root
+// of the package that owns init.lua, and may not lead outside of it.
+func luaRunLib(L *lua.LState, cfg *lua.LTable, env *runEnv) {
+	abs := func(path string) string {
+		path, err := luaConfine(env.path, path)
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		return path
+	}
+	L.SetField(cfg, "os", lua.LString(runtime.GOOS))
+	L.SetField(cfg, "arch", lua.LString(runtime.GOARCH))
+	L.SetField(cfg, "root", lua.LString(env.path))
+	L.SetField(cfg, "id", lua.LString(runid.String()))
+	L.SetField(cfg, "exists", L.NewFunction(func(L *lua.LState) int {
+		_, err := os.Stat(abs(L.CheckString(1)))
+		L.Push(lua.LBool(err == nil))
+		return 1
+	}))
+	L.SetField(cfg, "glob", L.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		matches, err := filepath.Glob(abs(pattern))
+		if err != nil {
+			L.RaiseError("bad glob pattern '%s': %s", pattern, err)
+		}
+		t := L.NewTable()
+		for _, match := range matches {
+			rel, err := filepath.Rel(env.path, match)
+			if err == nil && !filepath.IsAbs(pattern) {
+				match = rel
+			}
+			t.Append(lua.LString(match))
+		}
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(cfg, "readfile", L.NewFunction(func(L *lua.LState) int {
+		buf, err := os.ReadFile(abs(L.CheckString(1)))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(buf))
+		return 1
+	}))
+	L.SetField(cfg, "getenv", L.NewFunction(func(L *lua.LState) int {
+		if v, ok := os.LookupEnv(L.CheckString(1)); ok {
+			L.Push(lua.LString(v))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+	git := L.NewTable()
+	L.SetField(git, "branch", L.NewFunction(func(L *lua.LState) int {
+		cmd := exec.Command("git", "-C", env.path,
+			"symbolic-ref", "--short", "-q", "HEAD")
+		buf, err := cmd.Output()
+		if err != nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(lua.LString(strings.TrimSpace(string(buf))))
+		return 1
+	}))
+	L.SetField(cfg, "git", git)
+}
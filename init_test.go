@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLuaConfine(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "pkg")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(tmp, "secret")
+	if err := os.WriteFile(secret, []byte("s3cret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for path, outside := range map[string]bool{
+		"file":                       false,
+		"sub/../file":                false,
+		filepath.Join(root, "file"):  false,
+		"..":                         true,
+		"../secret":                  true,
+		"sub/../../secret":           true,
+		secret:                       true,
+		"link":                       true,
+		filepath.Join(root, "..x"):   false,
+		filepath.Join(tmp, "pkgish"): true,
+	} {
+		_, err := luaConfine(root, path)
+		if got := errors.Is(err, errOutside); got != outside {
+			t.Errorf("luaConfine(%q) = %v, want outside %v",
+				path, err, outside)
+		}
+	}
+}
@@ -26,21 +26,27 @@ func (env *runEnv) LoadLocks() error {
 	scanner := bufio.NewScanner(f)
 	for n := 1; scanner.Scan(); n++ {
 		line := scanner.Text()
-		url, rev, ok := strings.Cut(line, " ")
-		if !ok {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) < 2 || len(fields) > 3 {
 			return fmt.Errorf("bad lock (line %d): '%s'", n, line)
 		}
-		env.locks[url] = rev
+		env.locks[fields[0]] = fields[1]
+		if len(fields) > 2 {
+			env.lockids[fields[0]] = fields[2]
+		}
 	}
 	return nil
 }
 
-func (env *runEnv) SetLock(url, rev string) {
-	if env.root == nil {
-		env.locks[url] = rev
-	} else {
-		env.root.locks[url] = rev
+// SetLock locks url to a source revision and the id of its built package.
+func (env *runEnv) SetLock(url, rev, id string) {
+	if env.root != nil {
+		env = env.root
 	}
+	env.locks[url] = rev
+	env.lockids[url] = id
 }
 
 func (env *runEnv) WriteLocks() error {
@@ -50,7 +56,11 @@ func (env *runEnv) WriteLocks() error {
 
 	var lines []string
 	for url, rev := range env.locks {
-		lines = append(lines, fmt.Sprintf("%s %s", url, rev))
+		if id := env.lockids[url]; id != "" {
+			lines = append(lines, fmt.Sprintf("%s %s %s", url, rev, id))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s %s", url, rev))
+		}
 	}
 	sort.Strings(lines)
 
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	errCycle    = errors.New("import cycle")
+	errConflict = errors.New("conflicting revisions")
+)
+
+// resolver tracks the revision each package resolved to in this run.
+var resolver = struct {
+	sync.Mutex
+	revs map[string]string
+}{revs: make(map[string]string)}
+
+// importChain returns the urls whose builds led to env,
+// outermost first. Builds pass it down in RUNIMPORTS.
+func importChain(env *runEnv) []string {
+	return strings.Fields(env.env["RUNIMPORTS"])
+}
+
+// resolveCycle fails if url is in chain,
+// as the package must then (transitively) import itself.
+func resolveCycle(chain []string, url string) error {
+	i := slices.Index(chain, url)
+	if i < 0 {
+		return nil
+	}
+	cycle := append(slices.Clone(chain[i:]), url)
+	return fmt.Errorf("%w: %s", errCycle, strings.Join(cycle, " -> "))
+}
+
+// resolveRev reconciles the revision an importer locked url to with the
+// revision url already resolved to in this run, and records the result.
+//
+// RUNCONFLICT selects the policy for differing revisions: "newest" (the
+// default) picks the revision that descends from the other, and "fail"
+// rejects any difference. Revisions are reconciled as imports are reached,
+// so under "newest" an importer that was served the older revision before a
+// newer one was seen keeps it for the rest of the run.
+func resolveRev(url, rev string) (string, error) {
+	for {
+		resolver.Lock()
+		prev := resolver.revs[url]
+		resolver.Unlock()
+		pick, err := resolvePick(url, prev, rev)
+		if err != nil {
+			return "", err
+		}
+		// Comparing revisions runs git, so the lock is not held meanwhile;
+		// if another import resolved url in the meantime, decide again.
+		resolver.Lock()
+		if resolver.revs[url] == prev {
+			if pick != "" {
+				resolver.revs[url] = pick
+			}
+			resolver.Unlock()
+			return pick, nil
+		}
+		resolver.Unlock()
+	}
+}
+
+// resolvePick picks between prev, the revision url resolved to so far,
+// and rev, as resolveRev describes.
+func resolvePick(url, prev, rev string) (string, error) {
+	if prev == "" || rev == "" || prev == rev {
+		if prev != "" {
+			return prev, nil
+		}
+		return rev, nil
+	}
+	switch policy := os.Getenv("RUNCONFLICT"); policy {
+	case "", "newest":
+		if err := resolveFetch(url, prev, rev); err != nil {
+			return "", err
+		}
+		if gitIsAncestor(prev, rev) {
+			return rev, nil
+		} else if gitIsAncestor(rev, prev) {
+			return prev, nil
+		}
+		return "", fmt.Errorf("%w of '%s': %s and %s have diverged",
+			errConflict, url, prev, rev)
+	case "fail":
+		return "", fmt.Errorf("%w of '%s': %s and %s",
+			errConflict, url, prev, rev)
+	default:
+		return "", fmt.Errorf("bad RUNCONFLICT policy: %s", policy)
+	}
+}
+
+// resolveSet records the revision url resolved to, if resolveRev had none
+// to record, as for unlocked imports.
+func resolveSet(url, rev string) {
+	resolver.Lock()
+	defer resolver.Unlock()
+	if resolver.revs[url] == "" {
+		resolver.revs[url] = rev
+	}
+}
+
+// resolveFetch makes sure that a git source of url is cached to compare
+// revisions a and b in, fetching the source of b if neither is, as when
+// both are vendored or collected.
+func resolveFetch(url, a, b string) error {
+	if isLocalUrl(url) || isArchiveUrl(url) {
+		return nil
+	}
+	for _, rev := range []string{a, b} {
+		if _, ok := gitCached(rev); ok {
+			return nil
+		}
+	}
+	if _, _, err := gitSrc(url, b); err != nil {
+		return fmt.Errorf("failed to fetch '%s' to compare revisions: %w",
+			url, err)
+	}
+	return nil
+}
+
+// gitCached returns the cached git source of rev, if there is one.
+func gitCached(rev string) (string, bool) {
+	cache, err := cacheDir("src")
+	if err != nil {
+		return "", false
+	}
+	dir := filepath.Join(cache, rev)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// gitIsAncestor reports whether git revision a is an ancestor of b,
+// according to either of their cached sources.
+func gitIsAncestor(a, b string) bool {
+	for _, rev := range []string{a, b} {
+		dir, ok := gitCached(rev)
+		if !ok {
+			continue
+		}
+		cmd := exec.Command("git", "-C", dir,
+			"merge-base", "--is-ancestor", a, b)
+		if cmd.Run() == nil {
+			return true
+		}
+	}
+	return false
+}
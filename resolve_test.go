@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestResolveRevConcurrent(t *testing.T) {
+	t.Setenv("RUNCONFLICT", "fail")
+	url := "https://example.com/resolve-concurrent"
+	defer func() {
+		resolver.Lock()
+		delete(resolver.revs, url)
+		resolver.Unlock()
+	}()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, rev := range []string{"rev1", "rev2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = resolveRev(url, rev)
+		}()
+	}
+	wg.Wait()
+	var conflicts int
+	for _, err := range errs {
+		if errors.Is(err, errConflict) {
+			conflicts++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conflicts != 1 {
+		t.Errorf("resolveRev() errors = %v, want one conflict", errs)
+	}
+	resolver.Lock()
+	got := resolver.revs[url]
+	resolver.Unlock()
+	resolveSet(url, "rev3")
+	if rev, err := resolveRev(url, ""); err != nil || rev != got {
+		t.Errorf("resolveRev() = %q, %v, want recorded %q", rev, err, got)
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcVersion is the version of the protocol between run processes.
+// It must change whenever a request or response changes incompatibly.
+const rpcVersion = 1
+
+// RpcCode classifies an rpc failure so that clients can react to it.
+type RpcCode int
+
+const (
+	RpcOk RpcCode = iota
+	RpcErrInternal
+	RpcErrVersion
+	RpcErrHandshake
+	RpcErrNotFound
+	RpcErrAuth
+	RpcErrCycle
+	RpcErrConflict
+)
+
+var (
+	errRpcVersion   = errors.New("rpc version mismatch")
+	errRpcHandshake = errors.New("rpc handshake required")
+
+	rpcCodeErrs = map[RpcCode]error{
+		RpcErrVersion:   errRpcVersion,
+		RpcErrHandshake: errRpcHandshake,
+		RpcErrNotFound:  fs.ErrNotExist,
+		RpcErrAuth:      errAuth,
+		RpcErrCycle:     errCycle,
+		RpcErrConflict:  errConflict,
+	}
+)
+
+// RpcStatus is embedded in every response. Failures are reported here
+// rather than as net/rpc errors, which carry nothing but a string.
+type RpcStatus struct {
+	Code RpcCode
+	Err  string
+}
+
+func (s *RpcStatus) set(err error) {
+	if err == nil {
+		return
+	}
+	s.Code, s.Err = RpcErrInternal, err.Error()
+	for code, target := range rpcCodeErrs {
+		if errors.Is(err, target) {
+			s.Code = code
+			break
+		}
+	}
+}
+
+func (s *RpcStatus) status() *RpcStatus { return s }
+
+// rpcError is a failure reported by the rpc server.
+type rpcError struct {
+	code RpcCode
+	msg  string
+}
+
+func (e *rpcError) Error() string { return e.msg }
+
+func (e *rpcError) Is(target error) bool {
+	return rpcCodeErrs[e.code] == target
+}
+
+type HelloReq struct {
+	Version    int
+	RunVersion string
+}
+
+type HelloRes struct {
+	RpcStatus
+	Version    int
+	RunVersion string
+}
+
+type GetPkgReq struct {
+	Ctx      []string
+	Url      string
+	Platform string   // GOOS/GOARCH of the requesting run process.
+	Imports  []string // Urls whose builds led to this request.
+}
+
+type GetPkgRes struct {
+	RpcStatus
+	Path string
+	Rev  string
+	Id   string
+}
+
+type ResolveReq struct {
+	Ctx  []string
+	Argv []string
+}
+
+type ResolveRes struct {
+	RpcStatus
+	Path string   // Executable file, for file-based commands.
+	Argv []string // Command line, for commands registered by init.lua.
+}
+
+type InfoReq struct{}
+
+type InfoRes struct {
+	RpcStatus
+	Root    string
+	RunId   string
+	Version string
+}
+
+type LogReq struct {
+	Time  time.Time
+	Level string // One of debug, info, warn, or error.
+	Msg   string
+	Attrs []string // Alternating keys and values.
+}
+
+type LogRes struct {
+	RpcStatus
+}
+
+type CleanupReq struct {
+	Argv []string
+	Dir  string
+	Env  []string
+}
+
+type CleanupRes struct {
+	RpcStatus
+}
+
+type LockReq struct {
+	Name string
+}
+
+type LockRes struct {
+	RpcStatus
+}
+
+var lockName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// RpcSrv serves one connection from a child run process.
+type RpcSrv struct {
+	hello bool
+
+	mu     sync.Mutex
+	closed bool
+	locks  map[string]func()
+}
+
+// Hello checks that client and server speak the same protocol.
+// It must be the first call on a connection.
+func (s *RpcSrv) Hello(req *HelloReq, res *HelloRes) error {
+	res.Version, res.RunVersion = rpcVersion, version
+	if req.Version != rpcVersion {
+		res.set(fmt.Errorf("%w: client %s speaks v%d, server %s speaks v%d",
+			errRpcVersion, req.RunVersion, req.Version, version, rpcVersion))
+		return nil
+	}
+	s.hello = true
+	return nil
+}
+
+func (s *RpcSrv) GetPackage(req *GetPkgReq, res *GetPkgRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	res.set(s.getPackage(req, res))
+	return nil
+}
+
+func (s *RpcSrv) getPackage(req *GetPkgReq, res *GetPkgRes) (err error) {
+	base := baseEnv()
+	if err = base.LoadLocks(); err != nil {
+		return err
+	}
+	base.env["RUNIMPORTS"] = strings.Join(req.Imports, " ")
+	env, err := ctxEnv(base, req.Ctx)
+	if err != nil {
+		return err
+	}
+	platform := req.Platform
+	if platform == "" {
+		platform = hostPlatform
+	}
+	if res.Path, err = packageOut(env, req.Url, platform); err != nil {
+		return err
+	}
+	res.Rev, res.Id = base.locks[req.Url], filepath.Base(res.Path)
+	return nil
+}
+
+// ctxEnv returns the environment of the innermost package in ctx,
+// a list of store ids from the root project down. The caller's RUNROOT,
+// RUNCWD, and RUNRELDIR are left out.
+func ctxEnv(env *runEnv, ctx []string) (*runEnv, error) {
+	for _, k := range callerenv {
+		delete(env.env, k)
+	}
+	for _, pkg := range ctx {
+		if pkg == "" {
+			continue
+		}
+		path, err := pkgDir(pkg)
+		if err != nil {
+			return nil, err
+		}
+		env = env.Child(path)
+		if err := env.Init(); err != nil {
+			return nil, fmt.Errorf("failed to init package '%s': %w",
+				pkg, err)
+		}
+	}
+	return env, nil
+}
+
+// ResolveCommand finds the executable that argv would run.
+func (s *RpcSrv) ResolveCommand(req *ResolveReq, res *ResolveRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	env, err := ctxEnv(baseEnv(), req.Ctx)
+	if err != nil {
+		res.set(err)
+		return nil
+	}
+	env = env.Clone()
+	env.argv = req.Argv
+	cmd, _, err := lookCommand(env)
+	if errors.Is(err, errBadCmd) {
+		err = fmt.Errorf("%w: %s", fs.ErrNotExist, strings.Join(req.Argv, " "))
+	} else if err == nil {
+		res.Path, res.Argv = cmd.path, cmd.argv
+	}
+	res.set(err)
+	return nil
+}
+
+// Info reports the project being run by the top-level run process.
+func (s *RpcSrv) Info(_ *InfoReq, res *InfoRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	res.Root, res.RunId, res.Version = root, runid.String(), version
+	return nil
+}
+
+// Log prints a structured log event on behalf of a child process.
+// Debug events are only printed in verbose mode.
+func (s *RpcSrv) Log(req *LogReq, res *LogRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	if req.Level == "debug" && !*verbose {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", req.Time.Format(time.TimeOnly),
+		strings.ToUpper(req.Level), req.Msg)
+	for i := 0; i+1 < len(req.Attrs); i += 2 {
+		fmt.Fprintf(&b, " %s=%q", req.Attrs[i], req.Attrs[i+1])
+	}
+	fmt.Fprintln(os.Stderr, b.String())
+	return nil
+}
+
+// AddCleanup registers a command to run when the top-level run process
+// exits, even if it is interrupted.
+func (s *RpcSrv) AddCleanup(req *CleanupReq, res *CleanupRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	if len(req.Argv) < 1 {
+		res.set(errors.New("empty cleanup command"))
+		return nil
+	}
+	defers.add(func() {
+		cmd := exec.Command(req.Argv[0], req.Argv[1:]...)
+		cmd.Dir, cmd.Env = req.Dir, req.Env
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "cleanup '%s' failed: %s\n",
+				strings.Join(req.Argv, " "), err)
+		}
+	})
+	return nil
+}
+
+// Lock acquires a named lock, blocking until it is available.
+// Named locks are shared by all run processes on this machine and are
+// released by Unlock or when the connection that holds them closes.
+func (s *RpcSrv) Lock(req *LockReq, res *LockRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	if !lockName.MatchString(req.Name) {
+		res.set(fmt.Errorf("bad lock name: '%s'", req.Name))
+		return nil
+	}
+	// The name is reserved before waiting for the lock, so that a second
+	// Lock of it fails rather than waiting on this connection's own lock.
+	s.mu.Lock()
+	if _, held := s.locks[req.Name]; held || s.closed {
+		s.mu.Unlock()
+		res.set(fmt.Errorf("lock '%s' already held", req.Name))
+		return nil
+	}
+	if s.locks == nil {
+		s.locks = make(map[string]func())
+	}
+	s.locks[req.Name] = nil
+	s.mu.Unlock()
+
+	unlock, err := cacheLock("named", req.Name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err != nil:
+		delete(s.locks, req.Name)
+		res.set(err)
+	case s.closed:
+		unlock()
+	default:
+		s.locks[req.Name] = unlock
+	}
+	return nil
+}
+
+func (s *RpcSrv) Unlock(req *LockReq, res *LockRes) error {
+	if !s.hello {
+		res.set(errRpcHandshake)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock := s.locks[req.Name]
+	if unlock == nil {
+		res.set(fmt.Errorf("lock '%s' not held", req.Name))
+		return nil
+	}
+	delete(s.locks, req.Name)
+	unlock()
+	return nil
+}
+
+// close releases the locks held by a closed connection.
+func (s *RpcSrv) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, unlock := range s.locks {
+		if unlock != nil {
+			unlock()
+		}
+	}
+	s.locks = nil
+}
+
+// startRpcServer serves RpcSrv to child run processes.
+// It listens on a Unix socket in a private temp directory, falling back to
+// loopback TCP where Unix sockets are unavailable. Either way, clients must
+// present the random token in RUNRPCTOKEN before making calls.
+func startRpcServer() error {
+	dir, err := os.MkdirTemp("", "run")
+	if err != nil {
+		return fmt.Errorf("failed to create rpc directory: %w", err)
+	}
+	defers.add(func() { _ = os.RemoveAll(dir) })
+	addr := "unix:" + filepath.Join(dir, "rpc.sock")
+	l, err := net.Listen("unix", filepath.Join(dir, "rpc.sock"))
+	if err != nil {
+		if l, err = net.Listen("tcp4", "127.0.0.1:0"); err != nil {
+			return fmt.Errorf("failed to listen for rpc: %w", err)
+		}
+		addr = "tcp:" + l.Addr().String()
+	}
+	tok := make([]byte, 32)
+	if _, err := rand.Read(tok); err != nil {
+		return fmt.Errorf("failed to generate rpc token: %w", err)
+	}
+	token := hex.EncodeToString(tok)
+	go rpcAccept(l, token)
+	os.Setenv("RUNRPC", addr)
+	os.Setenv("RUNRPCTOKEN", token)
+	return nil
+}
+
+func rpcAccept(l net.Listener, token string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if !rpcAuth(conn, token) {
+				conn.Close()
+				return
+			}
+			rs := &RpcSrv{}
+			defer rs.close()
+			srv := rpc.NewServer()
+			if err := srv.Register(rs); err != nil {
+				conn.Close()
+				return
+			}
+			srv.ServeConn(conn)
+		}()
+	}
+}
+
+// rpcCtrDir is where the rpc socket directory is mounted in containers.
+const rpcCtrDir = "/tmp/run-rpc"
+
+// rpcCtr describes how a container reaches the rpc server.
+type rpcCtr struct {
+	volume []string
+	host   []string
+	addr   string
+}
+
+// rpcContainer returns the container options that make the rpc server
+// reachable from inside a container, and the RUNRPC to use there.
+//
+// On Linux, the socket's directory is bind-mounted into the container, and
+// rpcShare must then let the container's user at the socket.
+// Elsewhere, the container runtime runs in a VM that cannot share Unix
+// sockets, so the container dials the host through host-gateway instead.
+// On Linux, host-gateway is the bridge address rather than loopback, so a
+// TCP server is proxied there.
+func rpcContainer() (ctr rpcCtr, err error) {
+	network, addr, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	if network == "unix" && runtime.GOOS == "linux" {
+		ctr.volume = []string{filepath.Dir(addr) + ":" + rpcCtrDir}
+		ctr.addr = "unix:" + rpcCtrDir + "/" + filepath.Base(addr)
+		return
+	}
+	if network == "unix" {
+		addr, err = rpcProxy("unix", addr, "127.0.0.1:0")
+	} else if runtime.GOOS == "linux" {
+		var bridge string
+		if bridge, err = rpcBridge(); err != nil {
+			return
+		}
+		addr, err = rpcProxy("tcp", addr, net.JoinHostPort(bridge, "0"))
+	}
+	if err != nil {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ctr, fmt.Errorf("bad RUNRPC: '%s'", os.Getenv("RUNRPC"))
+	}
+	ctr.host = []string{"host.docker.internal:host-gateway"}
+	ctr.addr = "tcp:" + net.JoinHostPort("host.docker.internal", port)
+	return
+}
+
+// rpcShare gives uid, the user a container runs as, access to the rpc
+// socket mounted into it. The socket is handed to uid alone: its directory
+// only becomes searchable, not readable, by other users. Root and the
+// user run runs as need no access granted.
+func rpcShare(uid int) error {
+	network, path, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	if network != "unix" || uid == 0 || uid == os.Getuid() {
+		return nil
+	}
+	if err := os.Chown(path, uid, -1); err != nil {
+		return fmt.Errorf("failed to share rpc socket with container "+
+			"user %d; run the container as root or as uid %d: %w",
+			uid, os.Getuid(), err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("failed to share rpc socket: %w", err)
+	}
+	if err := os.Chmod(filepath.Dir(path), 0711); err != nil {
+		return fmt.Errorf("failed to share rpc directory: %w", err)
+	}
+	return nil
+}
+
+// rpcBridge returns the IPv4 address of the docker0 bridge,
+// which host-gateway resolves to on Linux.
+func rpcBridge() (string, error) {
+	iface, err := net.InterfaceByName("docker0")
+	if err != nil {
+		return "", fmt.Errorf("failed to find rpc bridge: %w", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to find rpc bridge: %w", err)
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("failed to find rpc bridge: " +
+		"docker0 has no IPv4 address")
+}
+
+// rpcProxy forwards TCP connections on listen to the rpc server at addr.
+// The token is checked by the server at the other end.
+func rpcProxy(network, addr, listen string) (string, error) {
+	l, err := net.Listen("tcp4", listen)
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for rpc: %w", err)
+	}
+	defers.add(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial(network, addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String(), nil
+}
+
+// rpcAuth reads the client's token, which precedes its first call.
+func rpcAuth(conn net.Conn, token string) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	buf := make([]byte, len(token)+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return false
+	}
+	return buf[len(token)] == '\n' &&
+		subtle.ConstantTimeCompare(buf[:len(token)], []byte(token)) == 1
+}
+
+// rpcDial connects to the rpc server of the top-level run process
+// and checks that it speaks the same protocol.
+func rpcDial(env *runEnv) (*rpc.Client, error) {
+	network, addr, ok := strings.Cut(env.env["RUNRPC"], ":")
+	if !ok || (network != "unix" && network != "tcp") {
+		return nil, fmt.Errorf("bad RUNRPC: '%s'", env.env["RUNRPC"])
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rpc server: %w", err)
+	}
+	_, err = io.WriteString(conn, env.env["RUNRPCTOKEN"]+"\n")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate to rpc server: %w",
+			err)
+	}
+	client := rpc.NewClient(conn)
+	req := &HelloReq{Version: rpcVersion, RunVersion: version}
+	var res HelloRes
+	if err = rpcCall(client, "RpcSrv.Hello", req, &res); err != nil {
+		client.Close()
+		return nil, err
+	} else if res.Version != rpcVersion {
+		client.Close()
+		return nil, fmt.Errorf("%w: client %s speaks v%d, "+
+			"server %s speaks v%d", errRpcVersion,
+			version, rpcVersion, res.RunVersion, res.Version)
+	}
+	return client, nil
+}
+
+// rpcCall calls method and converts a failure reported in the response's
+// status into an error.
+func rpcCall(client *rpc.Client, method string, req any,
+	res interface{ status() *RpcStatus }) error {
+	if err := client.Call(method, req, res); err != nil {
+		return fmt.Errorf("rpc %s failed: %w", method, err)
+	}
+	if s := res.status(); s.Code != RpcOk {
+		return &rpcError{code: s.Code, msg: s.Err}
+	}
+	return nil
+}
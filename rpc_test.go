@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// rpcTestServer starts an rpc server for a project in a temp directory,
+// with its own cache, and returns the project root.
+func rpcTestServer(t *testing.T) string {
+	t.Helper()
+	testCache(t)
+	t.Setenv("RUNRPC", "")
+	t.Setenv("RUNRPCTOKEN", "")
+	oldroot := root
+	root = t.TempDir()
+	t.Cleanup(func() { root = oldroot })
+	if err := startRpcServer(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(defers.run)
+	return root
+}
+
+// rpcTestConn connects to the rpc server without saying hello.
+func rpcTestConn(t *testing.T) *rpc.Client {
+	t.Helper()
+	network, addr, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(conn, os.Getenv("RUNRPCTOKEN")+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRpcDial(t *testing.T) {
+	rpcTestServer(t)
+	client, err := rpcDial(baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var res InfoRes
+	if err := rpcCall(client, "RpcSrv.Info", &InfoReq{}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Root != root || res.Version != version {
+		t.Errorf("Info = %q, %q, want %q, %q",
+			res.Root, res.Version, root, version)
+	}
+}
+
+func TestRpcBadToken(t *testing.T) {
+	rpcTestServer(t)
+	env := baseEnv()
+	env.env["RUNRPCTOKEN"] = strings.Repeat("0", 64)
+	if client, err := rpcDial(env); err == nil {
+		client.Close()
+		t.Fatal("rpcDial with bad token succeeded")
+	}
+}
+
+func TestRpcVersionMismatch(t *testing.T) {
+	rpcTestServer(t)
+	client := rpcTestConn(t)
+	req := &HelloReq{Version: rpcVersion + 1, RunVersion: "v0.0.0"}
+	var res HelloRes
+	err := rpcCall(client, "RpcSrv.Hello", req, &res)
+	if !errors.Is(err, errRpcVersion) || res.Code != RpcErrVersion {
+		t.Fatalf("Hello = %v (code %d), want RpcErrVersion", err, res.Code)
+	}
+	if res.Version != rpcVersion {
+		t.Errorf("Hello version = %d, want %d", res.Version, rpcVersion)
+	}
+}
+
+func TestRpcHandshake(t *testing.T) {
+	rpcTestServer(t)
+	client := rpcTestConn(t)
+	req := &GetPkgReq{Url: "example.com/pkg"}
+	var res GetPkgRes
+	err := rpcCall(client, "RpcSrv.GetPackage", req, &res)
+	if !errors.Is(err, errRpcHandshake) || res.Code != RpcErrHandshake {
+		t.Fatalf("GetPackage = %v (code %d), want RpcErrHandshake",
+			err, res.Code)
+	}
+}
+
+// rpcTestPkg makes a local package whose build leaves .run/hi in its output.
+func rpcTestPkg(t *testing.T) string {
+	t.Helper()
+	pkg := filepath.Join(t.TempDir(), "pkg")
+	if err := os.MkdirAll(filepath.Join(pkg, ".run"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(pkg, ".run", ".runpkg"),
+		[]byte("build sh -c 'mkdir -p out/.run && touch out/.run/hi'\n"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestRpcGetPackage(t *testing.T) {
+	dir := rpcTestServer(t)
+	pkg := rpcTestPkg(t)
+	env := baseEnv()
+	env.path = dir
+	path, err := pkgPath(env, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, id := env.locks[pkg], env.lockids[pkg]
+	if path == "" || rev == "" || id == "" {
+		t.Fatalf("GetPackage = %q, %q, %q, want non-empty", path, rev, id)
+	}
+	if filepath.Base(path) != id {
+		t.Errorf("GetPackage path %q is not id %q", path, id)
+	}
+	if _, err := os.Stat(filepath.Join(path, ".run", "hi")); err != nil {
+		t.Errorf("package not built: %v", err)
+	}
+}
+
+// TestRpcGetNested runs run -g in a child process, as a command run by run
+// would, so that it reaches the server through RUNRPC and RUNRPCTOKEN.
+func TestRpcGetNested(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds run")
+	}
+	bin := filepath.Join(t.TempDir(), "run")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	dir := rpcTestServer(t)
+	if err := os.WriteFile(filepath.Join(dir, ".runid"),
+		[]byte(uuid.New().String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := rpcTestPkg(t)
+
+	cmd := exec.Command(bin, "-g", pkg)
+	cmd.Dir = dir
+	// The child gets a cache of its own, so that a package it built itself
+	// rather than asking the server for would not be in the server's store.
+	cmd.Env = append(os.Environ(),
+		"HOME="+t.TempDir(),
+		"XDG_CACHE_HOME="+t.TempDir(),
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("run -g: %v\n%s", err, stderr.String())
+	}
+	path := strings.TrimSpace(string(out))
+	if _, err := os.Stat(filepath.Join(path, ".run", "hi")); err != nil {
+		t.Errorf("run -g printed %q, not a built package: %v", path, err)
+	}
+	store, err := cacheDir("store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != store {
+		t.Errorf("run -g printed %q, not in the server's store %s",
+			path, store)
+	}
+}
+
+func TestRpcContainer(t *testing.T) {
+	rpcTestServer(t)
+	network, addr, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	if network != "unix" || runtime.GOOS != "linux" {
+		t.Skip("needs a unix socket on linux")
+	}
+	ctr, err := rpcContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctr.volume) != 1 || ctr.addr != "unix:"+rpcCtrDir+"/rpc.sock" {
+		t.Errorf("rpcContainer() = %v, %q", ctr.volume, ctr.addr)
+	}
+	if err := rpcShare(os.Getuid()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Dir(addr))
+	if err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("rpc directory mode = %o, want private", perm)
+	}
+}
+
+func TestRpcShare(t *testing.T) {
+	rpcTestServer(t)
+	network, addr, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	if network != "unix" || runtime.GOOS != "linux" {
+		t.Skip("needs a unix socket on linux")
+	}
+	uid := os.Getuid() + 1
+	err := rpcShare(uid)
+	if os.Getuid() != 0 {
+		if err == nil {
+			t.Error("rpcShare() gave away the socket without privileges")
+		}
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("rpc socket mode = %o, want 600", perm)
+	}
+	if owner, _, err := getOwner(addr); err != nil {
+		t.Fatal(err)
+	} else if owner != uid {
+		t.Errorf("rpc socket owner = %d, want %d", owner, uid)
+	}
+}
+
+func TestRpcProxy(t *testing.T) {
+	rpcTestServer(t)
+	network, addr, _ := strings.Cut(os.Getenv("RUNRPC"), ":")
+	proxy, err := rpcProxy(network, addr, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := baseEnv()
+	env.env["RUNRPC"] = "tcp:" + proxy
+	client, err := rpcDial(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
@@ -8,9 +8,12 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"lesiw.io/ctrctl"
@@ -34,55 +37,104 @@ var (
 	printver  = flags.Bool("V,version", "print version")
 	get       = flags.String("g", "fetch and build other project")
 	imp       = flags.String("i", "import other project into RUNPATH")
+	gc        = flags.Bool("gc", "remove unused packages from the cache")
+	cacheinfo = flags.Bool("cache-info", "print cache usage by package")
+	cacheclr  = flags.Bool("cache-clean", "remove all cached packages")
+	hermetic  = flags.Bool("hermetic", "build packages in a clean environment")
+	reproduce = flags.Bool("check-reproducible", "build packages twice")
+	deps      = flags.Bool("deps", "print the package import tree")
+	why       = flags.String("why", "print where `command` comes from")
+	vendor    = flags.Bool("vendor", "copy locked packages into .run/vendor")
+	help      = flags.Bool("h", "print help for a command")
+	complete  = flags.String("complete", "print completions for `command`")
+	explain   = flags.Bool("explain", "print what a command would do")
+	initflag  = flags.Bool("init", "create .runid and a starter .run/")
+	logflag   = flags.String("log", "log a message at `level` via run")
+	lockflag  = flags.String("lock", "run a command holding the lock `name`")
+	onexit    = flags.Bool("on-exit", "run a command when run exits")
+	resolve   = flags.Bool("resolve", "print what a command would run")
 	usermap   = flags.Strings("u",
 		"chowns files based on a given `mapping` (uid:gid::uid:gid)")
 
 	root  string
+	cwd   string // The working directory run was started in.
 	runid uuid.UUID
 
 	//go:embed version.txt
 	versionfile string
 	version     string
+
+	//go:embed etc/init.lua
+	initlua []byte
 )
 
 func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
-	go func() {
-		<-sig
-		defers.run()
-		os.Exit(1)
-	}()
+	go handleSignals(sig)
 	if err := run(); err != nil {
 		if !errors.Is(err, errParse) {
 			fmt.Fprintln(os.Stderr, err)
 		}
-		os.Exit(1)
+		exit(1)
 	}
+	exit(0)
 }
 
 // nolint:gocyclo
 func run() (err error) {
-	defer defers.run()
 	version = strings.TrimSpace(versionfile)
-	if err := flags.Parse(os.Args[1:]...); err != nil {
+	own, cmdargs := splitArgs(flags, os.Args[1:])
+	if err := flags.Parse(own...); err != nil {
 		return errParse
 	}
+	flags.Args = append(flags.Args, cmdargs...)
 	if *printver {
 		fmt.Println(version)
 		return nil
 	} else if *install {
 		return installComp()
+	} else if *gc {
+		return cacheGc()
+	} else if *cacheinfo {
+		return cacheInfo()
+	} else if *cacheclr {
+		return cacheClean()
+	}
+	if cwd, err = os.Getwd(); err != nil {
+		return fmt.Errorf("failed to get current working directory: %s", err)
 	}
-	if err = changeToGitRoot(); err != nil {
-		return fmt.Errorf("failed to find git root: %s", err)
+	os.Setenv("RUNCWD", cwd)
+	if err = changeToRoot(); err != nil && *initflag {
+		err = os.Chdir(cwd) // Initialize a new project here.
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find project root: %s", err)
 	}
 	if root, err = os.Getwd(); err != nil {
 		return fmt.Errorf("failed to get current working directory: %s", err)
 	}
-	if runid, err = getProjectId(); err != nil {
+	os.Setenv("RUNRELDIR", relDir())
+	if *initflag {
+		return initProject()
+	}
+	if runid, err = getProjectId(root); err != nil {
+		return err
+	}
+	if err = registerProject(); err != nil {
 		return err
 	}
+	// Client commands talk to the run process that started this one, so
+	// they are dispatched before this one starts a server of its own.
+	if *logflag != "" {
+		return logCommand(*logflag, flags.Args)
+	} else if *lockflag != "" {
+		return lockCommand(*lockflag, flags.Args)
+	} else if *onexit {
+		return onExitCommand(flags.Args)
+	} else if *resolve {
+		return resolveCommand(flags.Args)
+	}
 	if err := errIf(os.Getenv("RUNRPC") == "", startRpcServer); err != nil {
 		return err
 	}
@@ -103,6 +155,17 @@ func run() (err error) {
 	}
 	if *get != "" {
 		return getPackage(env, *get)
+	} else if *deps {
+		return printDeps(env)
+	} else if *why != "" {
+		return whyCommand(*why)
+	} else if *complete != "" {
+		return completeCommand(*complete)
+	} else if *help && len(flags.Args) < 1 {
+		flags.PrintUsage()
+		return nil
+	} else if *vendor {
+		return vendorPackages(env)
 	} else if *imp != "" {
 		if err = importPackage(env, *imp); err != nil {
 			return err
@@ -114,11 +177,12 @@ func run() (err error) {
 	return execCommand(env.argv)
 }
 
-func getProjectId() (id uuid.UUID, err error) {
+// getProjectId returns the id of the project rooted at dir.
+func getProjectId(dir string) (id uuid.UUID, err error) {
 	// NOTE: .runid is in the project root rather than the .run directory
 	// to make it easy for other programs to identify the root of a run project
 	// and get its identifier - e.g. vcs host search.
-	runidfile := filepath.Join(root, ".runid")
+	runidfile := filepath.Join(dir, ".runid")
 	var rawid []byte
 	rawid, err = os.ReadFile(runidfile)
 	var pe *fs.PathError
@@ -134,20 +198,56 @@ func getProjectId() (id uuid.UUID, err error) {
 		err = fmt.Errorf("failed to read .runid file: %s", err)
 		return
 	}
-	id = uuid.New()
-	err = os.WriteFile(runidfile, []byte(id.String()+"\n"), 0644)
-	if err != nil {
-		err = fmt.Errorf("failed to write .runid file: %s", err)
-		return
+	return fallbackId(dir), nil
+}
+
+// fallbackId derives a stable project id for projects without a .runid,
+// from the git remote if there is one, or else from the root path.
+func fallbackId(dir string) uuid.UUID {
+	cmd := exec.Command("git", "-C", dir, "remote", "get-url", "origin")
+	if buf, err := cmd.Output(); err == nil {
+		remote := strings.TrimSpace(string(buf))
+		remote = strings.TrimSuffix(strings.TrimSuffix(remote, "/"), ".git")
+		if remote != "" {
+			return uuid.NewSHA1(uuid.NameSpaceURL, []byte(remote))
+		}
 	}
-	return
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("file://"+dir))
+}
+
+// initProject writes a .runid and a starter .run directory to the root.
+// Existing files are left alone.
+func initProject() error {
+	runidfile := filepath.Join(root, ".runid")
+	if _, err := os.Stat(runidfile); err != nil {
+		id := uuid.New().String() + "\n"
+		if err := os.WriteFile(runidfile, []byte(id), 0644); err != nil {
+			return fmt.Errorf("failed to write .runid file: %s", err)
+		}
+		fmt.Println("created", runidfile)
+	}
+	script := filepath.Join(root, ".run", "init.lua")
+	if _, err := os.Stat(script); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		return fmt.Errorf("failed to create .run directory: %s", err)
+	}
+	if err := os.WriteFile(script, initlua, 0644); err != nil {
+		return fmt.Errorf("failed to write init.lua: %s", err)
+	}
+	fmt.Println("created", script)
+	return nil
 }
 
 func execCommand(argv []string) error {
 	e := baseEnv()
 	e.argv = append([]string{}, argv...)
-	cmdpath, err := findExecutable(e)
-	if err == errBadCmd {
+	before := envmap()
+	found, foundenv, err := lookCommand(e)
+	if err == errBadCmd && *explain && len(unfetched) > 0 {
+		return explainUnfetched(e.argv)
+	} else if err == errBadCmd {
 		if len(e.argv) < 1 {
 			fmt.Fprintln(os.Stderr, "no command given. available commands:")
 		} else {
@@ -158,29 +258,100 @@ func execCommand(argv []string) error {
 	} else if err != nil {
 		return err
 	}
-	if os.Getenv("RUNCTRID") == "" && os.Getenv("RUNCTR") != "" {
-		return ctrCommand(e.argv)
+	layers, err := e.Layers()
+	if err != nil {
+		return err
+	}
+	e = layers[len(layers)-1] // Hooks come from every layer.
+	if err = found.loadParams(); err != nil {
+		return err
+	} else if *help {
+		found.printHelp()
+		return nil
+	}
+	if slices.Contains(layers, foundenv) {
+		setenv(e.env) // Nearest init.lua wins.
+	} else {
+		setenv(foundenv.env)
+	}
+	setenv(found.env)
+	if found.ctr != "" {
+		os.Setenv("RUNCTR", found.ctr)
 	}
 	var args []string
 	if len(e.argv) > 1 {
 		args = flags.Args[1:]
 	}
-	cmd := exec.Command(cmdpath, args...)
+	argenv, err := found.parseArgs(args)
+	if err != nil {
+		return err
+	}
+	setenv(argenv)
+	if *explain {
+		return explainCommand(e, found, foundenv, args, before)
+	}
+	ev := &hookEvent{name: e.argv[0], args: args, status: -1}
+	if os.Getenv("RUNCTRID") == "" {
+		if err = runHooks(e, "before", ev); err != nil {
+			return err
+		}
+		start := time.Now()
+		defers.add(func() { afterHooks(e, ev, start) })
+	}
+	if os.Getenv("RUNCTRID") == "" && os.Getenv("RUNCTR") != "" {
+		if err = waitStart(nil); err != nil {
+			return err
+		}
+		defer waitDone(nil)
+		err = ctrCommand(e.argv)
+		ev.status = exitStatus(err)
+		return err
+	}
+	cmd := found.cmd(args)
+	if found.incwd {
+		cmd.Dir = cwd
+	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err = cmd.Run(); err != nil {
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("error running command: %s", err)
+	}
+	if err = waitStart(cmd.Process); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	err = cmd.Wait()
+	ev.status = exitStatus(err)
+	waitDone(cmd.Process)
+	if err != nil {
 		return fmt.Errorf("error running command: %s", err)
 	}
 	return nil
 }
 
+// afterHooks runs the after and failure hooks of a command. It is deferred,
+// so that the hooks also run if run is interrupted.
+func afterHooks(e *runEnv, ev *hookEvent, start time.Time) {
+	ev.duration = time.Since(start)
+	if err := runHooks(e, "after", ev); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if ev.status == 0 {
+		return
+	}
+	if err := runHooks(e, "failure", ev); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
 func ctrCommand(argv []string) (err error) {
 	if os.Getenv("RUNCTRDEBUG") == "1" {
 		ctrctl.Verbose = true
 	}
 	defers.add(containerCleanup)
-	container, err := containerSetup()
+	container, rpcaddr, err := containerSetup()
 	if err != nil {
 		return err
 	}
@@ -189,10 +360,12 @@ func ctrCommand(argv []string) (err error) {
 			Cmd: attachCmd(),
 			Env: []string{
 				"RUNCTRID=" + container,
-				"RUNRPC=" + os.Getenv("RUNRPC"),
+				"RUNRPC=" + rpcaddr,
+				"RUNRPCTOKEN=" + os.Getenv("RUNRPCTOKEN"),
 			},
 			Interactive: true,
 			Tty:         isTty(),
+			Workdir:     path.Join("/work", filepath.ToSlash(relDir())),
 		},
 		container,
 		"run",
@@ -204,121 +377,227 @@ func ctrCommand(argv []string) (err error) {
 	return nil
 }
 
-func changeToGitRoot() error {
+// relDir returns the working directory run was started in, relative to root.
+func relDir() string {
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "."
+	}
+	return rel
+}
+
+// rootMarkers mark the root of a project: version control metadata,
+// which may be a file in git worktrees and submodules, or a .runid file.
+var rootMarkers = []string{".git", ".hg", ".jj", ".sl", ".runid"}
+
+// changeToRoot changes to the root of the project containing the working
+// directory. RUNROOT overrides the search. Outside of version control, the
+// topmost directory with a .run directory is the root.
+func changeToRoot() error {
+	if dir := os.Getenv("RUNROOT"); dir != "" {
+		return os.Chdir(dir)
+	}
+	var fallback string
 	for {
-		cwd, err := os.Getwd()
+		dir, err := os.Getwd()
 		if err != nil {
 			return err
 		}
-		fileinfo, err := os.Stat(".git")
-		if err == nil && fileinfo.IsDir() {
-			return nil
+		for _, marker := range rootMarkers {
+			if _, err := os.Stat(marker); err == nil {
+				return nil
+			}
 		}
-		reachedRoot := (cwd == "/" || cwd == (filepath.VolumeName(cwd)+"\\"))
+		if info, err := os.Stat(".run"); err == nil && info.IsDir() {
+			fallback = dir
+		}
+		reachedRoot := (dir == "/" || dir == (filepath.VolumeName(dir)+"\\"))
 		if reachedRoot || os.Chdir("..") != nil {
-			return fmt.Errorf("No .git directory was found.")
+			break
+		}
+	}
+	if fallback == "" {
+		return fmt.Errorf("no .git, .runid, or .run was found")
+	}
+	return os.Chdir(fallback)
+}
+
+// lookCommand searches e and the packages on its RUNPATH, breadth first,
+// for the command in e.argv. It also returns the environment it was found in.
+// Within a package, commands registered by init.lua shadow files in .run.
+// The project's own .run directories are searched first, nearest first.
+func lookCommand(e *runEnv) (*command, *runEnv, error) {
+	if len(e.argv) < 1 {
+		return nil, nil, errBadCmd
+	}
+	layers, err := e.Layers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if cmd := layers[i].ownCommand(); cmd != nil {
+			return cmd, layers[i], nil
 		}
 	}
+	var found *command
+	var foundenv *runEnv
+	err = walkEnvs(layers[len(layers)-1], func(e *runEnv) bool {
+		if len(e.argv) < 1 {
+			return true
+		}
+		name := e.argv[0]
+		if cmd := e.command(name); cmd != nil {
+			found, foundenv = cmd, e
+		} else if path, err := lookpath.Look(e.lpenv(), name); err == nil {
+			found, foundenv = &command{name: name, path: path}, e
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, nil, err
+	} else if found == nil {
+		return nil, nil, errBadCmd
+	}
+	return found, foundenv, nil
+}
+
+// ownCommand returns the command in e.argv if e itself provides it.
+func (e *runEnv) ownCommand() *command {
+	if len(e.argv) < 1 {
+		return nil
+	}
+	name := e.argv[0]
+	if cmd := e.command(name); cmd != nil {
+		return cmd
+	}
+	lpenv := e.lpenv()
+	lpenv["PATH"] = filepath.Join(e.path, ".run")
+	if path, err := lookpath.Look(lpenv, name); err == nil {
+		return &command{name: name, path: path}
+	}
+	return nil
 }
 
-func findExecutable(e *runEnv) (path string, err error) {
+// walkEnvs calls fn for e and each package on its RUNPATH, breadth first,
+// until fn returns false.
+func walkEnvs(e *runEnv, fn func(*runEnv) bool) error {
 	queue := []*runEnv{e}
 	for len(queue) > 0 {
 		e = queue[0]
 		queue = queue[1:]
-		if err = e.Init(); err != nil {
-			return
+		if err := e.Init(); err != nil {
+			return err
 		}
 		for _, path := range strings.Split(e.env["RUNPATH"], ":") {
 			if path == "" {
 				continue
 			}
-			e2 := e.Clone()
-			delete(e2.env, "RUNPATH")
-			e2.path = path
-			if e.Id() != "" && e2.env["RUNPKGS"] != "" {
-				e2.env["RUNPKGS"] = e2.env["RUNPKGS"] + ":" + e.Id()
-			} else if e.Id() != "" {
-				e2.env["RUNPKGS"] = e.Id()
-			}
-			queue = append(queue, e2)
+			queue = append(queue, e.Child(path))
 		}
-		if len(e.argv) < 1 {
-			continue
-		} else if path, err = lookpath.Look(e.lpenv(), e.argv[0]); err == nil {
-			setenv(e.env)
-			return
+		if !fn(e) {
+			return nil
 		}
 	}
-	err = errBadCmd
-	return
+	return nil
 }
 
-func runPath() string {
-	paths := os.Getenv("RUNPATH")
-	if paths == "" {
-		paths = "."
-	}
-	abspaths := strings.Builder{}
-	splitpaths := filepath.SplitList(paths)
-	sep := string(filepath.Separator)
-	for i, path := range splitpaths {
-		if i > 0 {
-			abspaths.WriteString(listsep)
-		}
-		parts := strings.Split(path, sep)
-		if len(parts) > 0 && parts[0] == "." {
-			parts[0] = root
-			abspaths.WriteString(strings.Join(parts, sep))
-		} else {
-			abspaths.WriteString(path)
-		}
+func completeCommand(name string) error {
+	e := baseEnv()
+	e.argv = []string{name}
+	cmd, _, err := lookCommand(e)
+	if errors.Is(err, errBadCmd) {
+		return nil
+	} else if err != nil {
+		return err
 	}
-	return abspaths.String()
+	if err = cmd.loadParams(); err != nil {
+		return err
+	}
+	for _, word := range cmd.completions() {
+		fmt.Println(word)
+	}
+	return nil
 }
 
 func listCommands() error {
-	// NOTE: This is duplicating lookpath logic
-	// and may return different results.
-	// Ideally, we should have one implementation of lookpath
-	// that takes a function that can be executed for each valid executable.
-	paths, err := cmdPaths()
+	cmds, err := allCommands(baseEnv())
 	if err != nil {
-		return err // FIXME: returns cryptic error if no .run/ directory.
+		return err
 	}
-	if len(paths) < 1 {
+	if len(cmds) < 1 {
 		fmt.Fprintln(os.Stderr, "<none>")
 		return nil
 	}
-	for _, path := range paths {
-		fmt.Println(filepath.Base(path))
+	tty := isTty()
+	for _, cmd := range cmds {
+		if tty && cmd.desc != "" {
+			fmt.Printf("%s\t%s\n", cmd.name, cmd.desc)
+		} else {
+			fmt.Println(cmd.name)
+		}
 	}
 	return nil
 }
 
-func cmdPaths() (cmds []string, err error) {
-	paths := runPath()
-	var files []fs.DirEntry
-	var info os.FileInfo
-	for _, path := range filepath.SplitList(paths) {
-		files, err = os.ReadDir(filepath.Join(path, ".run"))
+// allCommands lists the commands visible from e, in lookup order.
+// Commands shadowed by an earlier command of the same name are omitted.
+func allCommands(e *runEnv) (cmds []*command, err error) {
+	seen := make(map[string]bool)
+	dirs := make(map[string]bool)
+	add := func(cmd *command) {
+		if !seen[cmd.name] {
+			seen[cmd.name] = true
+			cmds = append(cmds, cmd)
+		}
+	}
+	layers, err := e.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		for _, cmd := range layers[i].commands {
+			add(cmd)
+		}
+		for _, path := range cmdFiles(filepath.Join(layers[i].path, ".run")) {
+			add(&command{name: filepath.Base(path), path: path})
+		}
+	}
+	err = walkEnvs(layers[len(layers)-1], func(e *runEnv) bool {
+		abs, err := filepath.Abs(e.path)
+		if err != nil || dirs[abs] {
+			return true
+		}
+		dirs[abs] = true
+		for _, cmd := range e.commands {
+			add(cmd)
+		}
+		for _, path := range cmdFiles(filepath.Join(abs, ".run")) {
+			add(&command{name: filepath.Base(path), path: path})
+		}
+		return true
+	})
+	return
+}
+
+// cmdFiles lists the executable files in dir.
+func cmdFiles(dir string) (cmds []string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if len(file.Name()) > 0 && file.Name()[0] == '.' {
+			continue
+		}
+		info, err := file.Info()
 		if err != nil {
-			return nil, fmt.Errorf("error reading directory: %s", err)
+			continue
 		}
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			if len(file.Name()) > 0 && file.Name()[0] == '.' {
-				continue
-			}
-			info, err = file.Info()
-			if err != nil {
-				return
-			}
-			if info.Mode()&0111 != 0 {
-				cmds = append(cmds, filepath.Join(path, file.Name()))
-			}
+		if info.Mode()&0111 != 0 {
+			cmds = append(cmds, filepath.Join(dir, file.Name()))
 		}
 	}
 	return
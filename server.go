@@ -1,66 +1,35 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"net"
-	"net/rpc"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
-func startRpcServer() error {
-	conn, err := net.Listen("tcp4", ":")
+// pkgPath fetches and builds the package at url via the top-level run
+// process and returns its path. The package is locked in env.
+func pkgPath(env *runEnv, url string) (string, error) {
+	client, err := rpcDial(env)
 	if err != nil {
-		return fmt.Errorf("failed to listen on tcp port: %w", err)
-	}
-	var srv RpcSrv
-	if err := rpc.Register(&srv); err != nil {
-		return fmt.Errorf("failed to register rpc server: %w", err)
-	}
-	go rpc.Accept(conn)
-	os.Setenv("RUNRPC", conn.Addr().String())
-	return nil
-}
-
-type RpcSrv struct{}
-
-type GetPkgReq struct {
-	ctx []string
-	url string
-}
-
-func (s *RpcSrv) GetPackage(req *GetPkgReq, path *string) (err error) {
-	env := baseEnv()
-	for _, pkg := range req.ctx {
-		if env.path, err = cacheDir("store", pkg); err != nil {
-			return fmt.Errorf("failed to find package '%s': %w", pkg, err)
-		} else if err := env.Init(); err != nil {
-			return fmt.Errorf("failed to init package '%s': %w", pkg, err)
-		}
+		return "", err
 	}
-	*path, err = packageOut(env, req.url)
-	return err
-}
-
-func pkgPath(env *runEnv, url string) (string, error) {
+	defer client.Close()
 	req := &GetPkgReq{
-		ctx: strings.Split(env.env["RUNPKGS"], ":"),
-		url: url,
-	}
-	client, err := rpc.Dial("tcp", env.env["RUNRPC"])
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to rpc server: %w", err)
+		Ctx:      strings.Split(env.env["RUNPKGS"], ":"),
+		Url:      url,
+		Platform: hostPlatform,
+		Imports:  importChain(env),
 	}
-	var path string
-	if err := client.Call("RpcSrv.GetPackage", req, &path); err != nil {
+	var res GetPkgRes
+	if err := rpcCall(client, "RpcSrv.GetPackage", req, &res); err != nil {
 		return "", err
 	}
-	return path, nil
+	env.SetLock(url, res.Rev, res.Id)
+	return res.Path, nil
 }
 
 func getPackage(env *runEnv, url string) error {
@@ -73,21 +42,47 @@ func getPackage(env *runEnv, url string) error {
 }
 
 func importPackage(env *runEnv, url string) error {
-	path, err := pkgPath(env, url)
-	if err != nil {
+	var path string
+	var err error
+	if *explain {
+		path, err = explainPackage(env, url)
+	} else {
+		path, err = pkgPath(env, url)
+	}
+	if err != nil || path == "" {
 		return err
 	}
 	bin := filepath.Join(path, ".run")
 	if _, err = os.Stat(bin); err != nil {
 		return fmt.Errorf("failed to import '%s': no .run directory", url)
 	}
-	env.env["RUNPATH"] = env.env["RUNPATH"] + listsep + path + listsep
+	paths := filepath.SplitList(env.env["RUNPATH"])
+	if !slices.Contains(paths, path) {
+		env.env["RUNPATH"] = strings.Join(append(paths, path), listsep)
+	}
+	env.imports = append(env.imports, pkgImport{url: url, path: path})
 	return nil
 }
 
-func packageOut(env *runEnv, url string) (out string, err error) {
-	rev := env.locks[url]
-	if !strings.Contains(url, "@") {
+func packageOut(env *runEnv, name, platform string) (
+	out string, err error,
+) {
+	url, rev := name, env.locks[name]
+	if id := env.lockids[name]; id != "" && rev != "" {
+		if path, ok, err := vendored(id); err != nil {
+			return "", err
+		} else if ok {
+			return path, nil
+		}
+	}
+	switch {
+	case isLocalUrl(url):
+		url, rev = localPath(env, url), ""
+	case isArchiveUrl(url):
+		if rev, err = archivePin(url, rev); err != nil {
+			return "", err
+		}
+	case !strings.Contains(url, "@"):
 		if !strings.Contains(url, "://") {
 			url = "https://" + url
 		}
@@ -95,13 +90,27 @@ func packageOut(env *runEnv, url string) (out string, err error) {
 		if err != nil {
 			return "", fmt.Errorf("failed to fetch url '%s': %w", url, err)
 		}
+		if isArchiveUrl(url) {
+			if rev, err = archivePin(url, rev); err != nil {
+				return "", err
+			}
+		}
+	}
+	chain := importChain(env)
+	if err = resolveCycle(chain, url); err != nil {
+		return "", err
+	}
+	if rev, err = resolveRev(url, rev); err != nil {
+		return "", err
 	}
 	if rev != "" {
-		cachepath, err := storeByRev(rev)
+		cachepath, err := storeByRev(rev, platform)
 		if err != nil {
 			return "", err
 		}
 		if cachepath != "" {
+			env.SetLock(name, rev, filepath.Base(cachepath))
+			resolveSet(url, rev)
 			return cachepath, nil
 		}
 	}
@@ -109,72 +118,32 @@ func packageOut(env *runEnv, url string) (out string, err error) {
 	if err != nil {
 		return "", err
 	}
-	out, err = packageBuild(src)
+	out, err = packageBuild(src, buildCtx{
+		platform: platform,
+		imports:  append(chain, url),
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to build '%s': %w", url, err)
 	}
-	env.SetLock(url, rev)
+	env.SetLock(name, rev, filepath.Base(out))
+	resolveSet(url, rev)
 	return out, nil
 }
 
-func packageSrc(url, rev string) (string, string, error) {
-	dir, err := os.MkdirTemp("", "run")
+func packageBuild(src string, b buildCtx) (string, error) {
+	bysrc, err := cacheDir("store", "by-src")
 	if err != nil {
-		return "", rev, fmt.Errorf("failed to create temp directory: %w", err)
-	}
-	defers.add(func() { _ = os.RemoveAll(dir) })
-	cmd := exec.Command("git", "clone", url, dir)
-	if *verbose {
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
-	}
-	if err := cmd.Run(); err != nil {
-		// TODO: if not verbose, return stderr
-		return "", rev, fmt.Errorf("failed to clone '%s': %w", url, err)
-	}
-
-	if rev == "" {
-		cmd = exec.Command("git", "-C", dir, "rev-parse", "HEAD")
-		buf, err := cmd.Output()
-		if err != nil {
-			return "", rev,
-				fmt.Errorf("failed to get HEAD rev from '%s': %w", url, err)
-		}
-		rev = strings.Trim(string(buf), "\n")
-	} else {
-		cmd = exec.Command("git", "-C", dir, "checkout", rev)
-		if *verbose {
-			cmd.Stdout = os.Stderr
-			cmd.Stderr = os.Stderr
-		}
-		if err := cmd.Run(); err != nil {
-			// TODO: if not verbose, return stderr
-			return "", rev, fmt.Errorf(
-				"failed to checkout rev '%s' from '%s': %w", rev, url, err)
-		}
+		return "", err
 	}
-
-	cache, err := cacheDir("src")
-	if err != nil {
-		return "", rev, err
-	}
-
-	path := filepath.Join(cache, rev)
-	if _, err = os.Stat(path); err == nil {
-		return path, rev, nil
-	}
-
-	err = os.Rename(dir, path)
-	return path, rev, err
-}
-
-func packageBuild(src string) (string, error) {
-	bysrc, err := cacheDir("store", "by-src")
+	rev := filepath.Base(src)
+	key := bysrcKey(rev, b.platform)
+	unlock, err := cacheLock("by-src", key)
 	if err != nil {
 		return "", err
 	}
-	cachepath := filepath.Join(bysrc, filepath.Base(src))
-	if _, err := os.Lstat(cachepath); err == nil {
+	defer unlock()
+	cachepath := filepath.Join(bysrc, key)
+	if _, err := os.Stat(cachepath); err == nil {
 		if cachepath, err := filepath.EvalSymlinks(cachepath); err != nil {
 			return "", fmt.Errorf("failed evaluating symlink: %w", err)
 		} else {
@@ -182,32 +151,31 @@ func packageBuild(src string) (string, error) {
 		}
 	}
 
-	run, err := os.Executable()
-	if err != nil {
-		run = "run"
-	}
-	cmd := exec.Command(run)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = src
-	if err = cmd.Run(); err != nil {
-		return "", fmt.Errorf("run failed: %w", err)
-	}
-	out := filepath.Join(src, "out")
-	if _, err = os.Stat(out); err != nil {
-		return "", err
+	var pristine string
+	if *reproduce {
+		if pristine, err = cacheTemp(); err != nil {
+			return "", err
+		}
+		pristine = filepath.Join(pristine, rev)
+		if err = copyTree(src, pristine); err != nil {
+			return "", fmt.Errorf("failed to copy source: %w", err)
+		}
 	}
-	hash, err := hashDir(out, "", hash1)
+	out, hash, err := buildOut(src, b)
 	if err != nil {
 		return "", err
 	}
+	if pristine != "" {
+		if err = checkReproducible(pristine, hash, b); err != nil {
+			return "", err
+		}
+	}
 	cache, err := cacheDir("store")
 	if err != nil {
 		return "", err
 	}
 	path := filepath.Join(cache, hash)
-	if err = storeCopy(out, path); err != nil {
+	if err = storePublish(out, path); err != nil {
 		return "", fmt.Errorf("failed copying output dir: %w", err)
 	}
 	relpath, err := filepath.Rel(bysrc, path)
@@ -215,6 +183,7 @@ func packageBuild(src string) (string, error) {
 		return "", fmt.Errorf(
 			"failed calculating relative path to package output: %w", err)
 	}
+	_ = os.Remove(cachepath) // Dangling symlink, if any.
 	err = os.Symlink(relpath, cachepath)
 	if err != nil {
 		return "", fmt.Errorf("failed creating by-src symlink: %w", err)
@@ -222,63 +191,163 @@ func packageBuild(src string) (string, error) {
 	return path, nil
 }
 
-func storeCopy(src, dst string) error {
-	_, err := os.Stat(dst)
+// storePublish copies a build output directory into the store at path.
+// The copy is staged in a temp directory, verified against its hash, and
+// renamed into place, so other run processes never see a partial or
+// corrupt store entry.
+func storePublish(out, path string) error {
+	unlock, err := cacheLock("store", filepath.Base(path))
 	if err != nil {
-		return nil // Nothing to do.
+		return err
 	}
-	if !errors.Is(err, os.ErrNotExist) {
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		return nil // Identical entry already published.
+	}
+	tmp, err := cacheTemp()
+	if err != nil {
 		return err
 	}
-	copyfunc := func(srcpath string, d fs.DirEntry, _ error) error {
+	stage := filepath.Join(tmp, "out")
+	if err = storeCopy(out, stage); err != nil {
+		return err
+	}
+	hash, err := hashDir(stage, "", hash1)
+	if err != nil {
+		return fmt.Errorf("failed to hash store entry: %w", err)
+	} else if hash != filepath.Base(path) {
+		return fmt.Errorf("store entry hash mismatch: got %s, want %s",
+			hash, filepath.Base(path))
+	}
+	if err = cacheRename(stage, path); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0555)
+}
+
+// storeCopy copies the package at src to dst, which must not exist.
+// Regular files are hardlinked from a content-addressed pool when possible,
+// symlinks are preserved if they stay within the package, and every file
+// and directory below dst is made read-only.
+func storeCopy(src, dst string) error {
+	var dirs []string
+	copyfunc := func(srcpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 		relpath, err := filepath.Rel(src, srcpath)
 		if err != nil {
 			return err
 		}
 		dstpath := filepath.Join(dst, relpath)
-		if d.IsDir() {
-			return os.Mkdir(dstpath, 0777)
-		}
-		if !d.Type().IsRegular() {
+		switch {
+		case d.IsDir():
+			if relpath != "." {
+				dirs = append(dirs, dstpath)
+			}
+			return os.Mkdir(dstpath, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			return storeSymlink(src, srcpath, dstpath)
+		case d.Type().IsRegular():
+			return storeFile(srcpath, dstpath)
+		default:
 			return fmt.Errorf("failed to copy '%s': not a regular file",
 				srcpath)
 		}
-		info, err := os.Stat(srcpath)
-		if err != nil {
-			return err
-		}
-		var exec fs.FileMode
-		if info.Mode()&0111 != 0 {
-			exec = 0111
-		}
-		srcfile, err := os.OpenFile(srcpath, os.O_RDONLY, 0)
-		if err != nil {
-			return err
-		}
-		defer srcfile.Close()
-		dstfile, err := os.OpenFile(dstpath,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666|exec)
-		if err != nil {
-			return err
-		}
-		defer dstfile.Close()
-		if _, err = io.Copy(dstfile, srcfile); err != nil {
+	}
+	if err := filepath.WalkDir(src, copyfunc); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], 0555); err != nil {
 			return err
 		}
-		if err = os.Chmod(dstpath, 0444|exec); err != nil {
+	}
+	return nil
+}
+
+func storeSymlink(root, srcpath, dstpath string) error {
+	target, err := os.Readlink(srcpath)
+	if err != nil {
+		return err
+	}
+	abs := target
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(filepath.Dir(srcpath), target)
+	}
+	if rel, err := filepath.Rel(root, abs); err != nil ||
+		filepath.IsAbs(target) || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("failed to copy '%s': symlink leaves package",
+			srcpath)
+	}
+	return os.Symlink(target, dstpath)
+}
+
+// storeFile links srcpath into the store at dstpath by way of the file pool,
+// falling back to a copy when the filesystem does not support hardlinks.
+func storeFile(srcpath, dstpath string) error {
+	info, err := os.Stat(srcpath)
+	if err != nil {
+		return err
+	}
+	var exec fs.FileMode
+	if info.Mode()&0111 != 0 {
+		exec = 0111
+	}
+	sum, err := sha256File(srcpath)
+	if err != nil {
+		return err
+	}
+	pool, err := cacheDir("files")
+	if err != nil {
+		return err
+	}
+	kind := "r"
+	if exec != 0 {
+		kind = "x"
+	}
+	poolpath := filepath.Join(pool, sum+"-"+kind)
+	if _, err := os.Stat(poolpath); err != nil {
+		if err = storeFileCopy(srcpath, poolpath, exec); err != nil {
 			return err
 		}
+	}
+	if err := os.Link(poolpath, dstpath); err == nil {
 		return nil
 	}
-	return filepath.WalkDir(src, copyfunc)
+	return storeFileCopy(srcpath, dstpath, exec)
 }
 
-func storeByRev(rev string) (string, error) {
+func storeFileCopy(srcpath, dstpath string, exec fs.FileMode) error {
+	srcfile, err := os.Open(srcpath)
+	if err != nil {
+		return err
+	}
+	defer srcfile.Close()
+	dstfile, err := os.CreateTemp(filepath.Dir(dstpath), ".copy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dstfile.Name())
+	defer dstfile.Close()
+	if _, err = io.Copy(dstfile, srcfile); err != nil {
+		return err
+	}
+	if err = dstfile.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(dstfile.Name(), 0444|exec); err != nil {
+		return err
+	}
+	return os.Rename(dstfile.Name(), dstpath)
+}
+
+func storeByRev(rev, platform string) (string, error) {
 	bysrc, err := cacheDir("store", "by-src")
 	if err != nil {
 		return "", err
 	}
-	cachepath := filepath.Join(bysrc, rev)
+	cachepath := filepath.Join(bysrc, bysrcKey(rev, platform))
 	if _, err := os.Lstat(cachepath); err == nil {
 		if cachepath, err := filepath.EvalSymlinks(cachepath); err != nil {
 			return "", fmt.Errorf("failed evaluating symlink: %w", err)
@@ -288,3 +357,9 @@ func storeByRev(rev string) (string, error) {
 	}
 	return "", nil
 }
+
+// bysrcKey names the store/by-src entry of a source revision built for
+// platform, since a package's output can differ between platforms.
+func bysrcKey(rev, platform string) string {
+	return rev + "@" + strings.ReplaceAll(platform, "/", "-")
+}
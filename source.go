@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+func isLocalUrl(url string) bool {
+	if strings.HasPrefix(url, "file://") {
+		return !isArchiveUrl(url)
+	}
+	return url == "." || url == ".." || filepath.IsAbs(url) ||
+		strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../")
+}
+
+func isArchiveUrl(url string) bool {
+	if !strings.HasPrefix(url, "https://") &&
+		!strings.HasPrefix(url, "http://") &&
+		!strings.HasPrefix(url, "file://") {
+		return false
+	}
+	url, _, _ = strings.Cut(url, "#")
+	url, _, _ = strings.Cut(url, "?")
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(url, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// localPath resolves a local package url relative to the importing package.
+func localPath(env *runEnv, url string) string {
+	url = strings.TrimPrefix(url, "file://")
+	if filepath.IsAbs(url) {
+		return filepath.Clean(url)
+	}
+	return filepath.Join(env.path, url)
+}
+
+// archivePin returns the revision an archive url is pinned to.
+// Archives are pinned with a sha256 fragment, e.g. pkg.tar.gz#sha256=abc.
+func archivePin(url, rev string) (string, error) {
+	_, frag, _ := strings.Cut(url, "#")
+	if frag == "" {
+		return rev, nil
+	}
+	sum, ok := strings.CutPrefix(frag, "sha256=")
+	if !ok {
+		return "", fmt.Errorf("bad archive fragment '%s': want sha256=HEX",
+			frag)
+	}
+	pin := "sha256_" + strings.ToLower(sum)
+	if rev != "" && rev != pin {
+		return "", fmt.Errorf("lock for '%s' does not match pinned sha256",
+			url)
+	}
+	return pin, nil
+}
+
+func packageSrc(url, rev string) (string, string, error) {
+	switch {
+	case isLocalUrl(url):
+		return localSrc(url)
+	case isArchiveUrl(url):
+		return archiveSrc(url, rev)
+	default:
+		return gitSrc(url, rev)
+	}
+}
+
+func gitSrc(url, rev string) (string, string, error) {
+	dir, err := cacheTemp()
+	if err != nil {
+		return "", rev, err
+	}
+	cmd := exec.Command("git", "clone", url, dir)
+	cmd.Env = gitAuthEnv(url)
+	var stderr strings.Builder
+	if *verbose {
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	} else {
+		cmd.Stderr = &stderr
+	}
+	if err := cmd.Run(); err != nil {
+		if err := gitAuthError(url, stderr.String()); err != nil {
+			return "", rev, err
+		}
+		// TODO: if not verbose, return stderr
+		return "", rev, fmt.Errorf("failed to clone '%s': %w", url, err)
+	}
+
+	if rev == "" {
+		cmd = exec.Command("git", "-C", dir, "rev-parse", "HEAD")
+		buf, err := cmd.Output()
+		if err != nil {
+			return "", rev,
+				fmt.Errorf("failed to get HEAD rev from '%s': %w", url, err)
+		}
+		rev = strings.Trim(string(buf), "\n")
+	} else {
+		cmd = exec.Command("git", "-C", dir, "checkout", rev)
+		if *verbose {
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+		}
+		if err := cmd.Run(); err != nil {
+			// TODO: if not verbose, return stderr
+			return "", rev, fmt.Errorf(
+				"failed to checkout rev '%s' from '%s': %w", rev, url, err)
+		}
+	}
+	return srcPublish(dir, rev)
+}
+
+// localSrc snapshots a local directory into the source cache.
+// Its revision is the hash of its contents, so edits produce a new build.
+func localSrc(dir string) (string, string, error) {
+	files, err := localFiles(dir)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read '%s': %w", dir, err)
+	}
+	rev, err := hash1(files, func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash '%s': %w", dir, err)
+	}
+	if path, ok, err := srcCached(rev); err != nil || ok {
+		return path, rev, err
+	}
+	tmp, err := cacheTemp()
+	if err != nil {
+		return "", rev, err
+	}
+	for _, file := range files {
+		err := copyEntry(
+			filepath.Join(dir, filepath.FromSlash(file)),
+			filepath.Join(tmp, filepath.FromSlash(file)),
+		)
+		if err != nil {
+			return "", rev, err
+		}
+	}
+	return srcPublish(markRoot(tmp, rev), rev)
+}
+
+// localFiles lists the files and symlinks of a local package, as hash1
+// expects, skipping version control metadata and previous build output.
+func localFiles(dir string) (files []string, err error) {
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == ".git" || rel == "out" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}
+	err = filepath.WalkDir(dir, walk)
+	return
+}
+
+func archiveSrc(url, rev string) (string, string, error) {
+	if path, ok, err := srcCached(rev); err != nil || ok {
+		return path, rev, err
+	}
+	tmp, err := cacheTemp()
+	if err != nil {
+		return "", rev, err
+	}
+	name, _, _ := strings.Cut(url, "#")
+	file := filepath.Join(tmp, "archive")
+	if local, ok := strings.CutPrefix(name, "file://"); ok {
+		err = copyFile(local, file)
+	} else {
+		err = downloadUrl(name, file)
+	}
+	if err != nil {
+		return "", rev, err
+	}
+	sum, err := sha256File(file)
+	if err != nil {
+		return "", rev, err
+	}
+	if rev != "" && rev != sum {
+		return "", rev, fmt.Errorf("sha256 mismatch for '%s': got %s, want %s",
+			url, sum, rev)
+	}
+	dir := filepath.Join(tmp, "src")
+	if err = extractArchive(name, file, dir); err != nil {
+		return "", sum, fmt.Errorf("failed to extract '%s': %w", url, err)
+	}
+	return srcPublish(markRoot(archiveRoot(dir), sum), sum)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256_" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func extractArchive(name, file, dir string) error {
+	name, _, _ = strings.Cut(name, "?")
+	if strings.HasSuffix(name, ".zip") {
+		return extractZip(file, dir)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(name, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		dst, err := archivePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, 0755)
+		case tar.TypeReg:
+			err = writeFile(dst, tr, fs.FileMode(hdr.Mode))
+		case tar.TypeSymlink:
+			if err = archiveLink(dir, dst, hdr.Linkname); err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, dst)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(file, dir string) error {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, zf := range z.File {
+		dst, err := archivePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err = os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeFile(dst, r, zf.Mode())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivePath returns the destination of an archive member,
+// rejecting members that would escape dir, either by name or by way of
+// a symlink extracted earlier.
+func archivePath(dir, name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return dir, nil
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(dst, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("bad archive member: %s", name)
+	}
+	cur := dir
+	for _, part := range strings.Split(name[1:], "/") {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if err != nil {
+			break
+		} else if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("bad archive member: %s: through symlink",
+				name)
+		}
+	}
+	return dst, nil
+}
+
+// archiveLink rejects a symlink at dst whose target is absolute or
+// resolves outside of dir.
+func archiveLink(dir, dst, target string) error {
+	if filepath.IsAbs(target) || path.IsAbs(target) {
+		return fmt.Errorf("bad archive symlink: %s -> %s", dst, target)
+	}
+	abs := filepath.Join(filepath.Dir(dst), filepath.FromSlash(target))
+	if abs != dir && !strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+		return fmt.Errorf("bad archive symlink: %s -> %s", dst, target)
+	}
+	return nil
+}
+
+// archiveRoot descends into dir if it contains nothing but one directory,
+// as is conventional for source tarballs.
+func archiveRoot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return dir
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
+
+func writeFile(path string, r io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0644|(mode&0111))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(dst, f, info.Mode())
+}
+
+// copyEntry copies the file or symlink src to dst.
+func copyEntry(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return copyFile(src, dst)
+	}
+	link, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(link, dst)
+}
+
+// markRoot marks dir as a project root so that run can build it, with a
+// .runid derived from rev unless the source has its own.
+func markRoot(dir, rev string) string {
+	runidfile := filepath.Join(dir, ".runid")
+	if _, err := os.Lstat(runidfile); err == nil {
+		return dir
+	}
+	id := uuid.NewSHA1(uuid.NameSpaceURL, []byte("run-src:"+rev))
+	_ = os.WriteFile(runidfile, []byte(id.String()+"\n"), 0644)
+	return dir
+}
+
+func srcCached(rev string) (string, bool, error) {
+	if rev == "" {
+		return "", false, nil
+	}
+	cache, err := cacheDir("src")
+	if err != nil {
+		return "", false, err
+	}
+	path := filepath.Join(cache, rev)
+	if _, err = os.Stat(path); err == nil {
+		return path, true, nil
+	}
+	return "", false, nil
+}
+
+// srcPublish moves a fetched source directory into the source cache.
+func srcPublish(dir, rev string) (string, string, error) {
+	cache, err := cacheDir("src")
+	if err != nil {
+		return "", rev, err
+	}
+	unlock, err := cacheLock("src", rev)
+	if err != nil {
+		return "", rev, err
+	}
+	defer unlock()
+
+	path := filepath.Join(cache, rev)
+	if _, err = os.Stat(path); err == nil {
+		return path, rev, nil
+	}
+
+	err = cacheRename(dir, path)
+	return path, rev, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	link string // Symlink target, if a symlink.
+	body string
+}
+
+func writeTar(t *testing.T, path string, entries []tarEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644}
+		if e.link != "" {
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		} else {
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveEscape(t *testing.T) {
+	tmp := t.TempDir()
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+	}{{
+		name: "write through symlink",
+		entries: []tarEntry{
+			{name: "evil", link: outside},
+			{name: "evil/file", body: "pwned"},
+		},
+		wantErr: true,
+	}, {
+		name: "relative symlink out",
+		entries: []tarEntry{
+			{name: "evil", link: "../outside"},
+			{name: "evil/file", body: "pwned"},
+		},
+		wantErr: true,
+	}, {
+		name: "overwrite symlink",
+		entries: []tarEntry{
+			{name: "evil", link: "ok"},
+			{name: "evil", body: "pwned"},
+		},
+		wantErr: true,
+	}, {
+		// Names are cleaned into dir rather than rejected.
+		name:    "dotdot name",
+		entries: []tarEntry{{name: "../outside/file", body: "pwned"}},
+	}}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(tmp, "a.tar")
+			writeTar(t, archive, tt.entries)
+			dir := filepath.Join(tmp, "src", string(rune('a'+i)))
+			err := extractArchive("a.tar", archive, dir)
+			if tt.wantErr && err == nil {
+				t.Errorf("extractArchive() = nil, want error")
+			}
+			if _, err := os.Stat(filepath.Join(outside, "file")); err == nil {
+				t.Fatalf("archive wrote outside of its directory")
+			}
+		})
+	}
+}
+
+func TestExtractArchiveSymlink(t *testing.T) {
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "a.tar")
+	writeTar(t, archive, []tarEntry{
+		{name: "pkg/bin/tool", body: "#!/bin/sh\n"},
+		{name: "pkg/tool", link: "bin/tool"},
+	})
+	dir := filepath.Join(tmp, "src")
+	if err := extractArchive("a.tar", archive, dir); err != nil {
+		t.Fatalf("extractArchive() = %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(dir, "pkg", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	} else if target != "bin/tool" {
+		t.Errorf("symlink target = %q, want %q", target, "bin/tool")
+	}
+}
+
+func TestLocalSrcSymlink(t *testing.T) {
+	testCache(t)
+	tmp := t.TempDir()
+	pkg := filepath.Join(tmp, "pkg")
+	if err := os.MkdirAll(filepath.Join(pkg, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(pkg, "bin", "tool")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(pkg, "tool")); err != nil {
+		t.Fatal(err)
+	}
+	path, rev, err := localSrc(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(path, "tool")); err != nil {
+		t.Fatal(err)
+	} else if target != "bin/tool" {
+		t.Errorf("symlink target = %q, want %q", target, "bin/tool")
+	}
+	if _, err := os.Stat(filepath.Join(path, ".runid")); err != nil {
+		t.Errorf("snapshot has no .runid: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		t.Error("snapshot has a .git")
+	}
+
+	// The same tree from an archive hashes the same.
+	archive := filepath.Join(tmp, "a.tar")
+	writeTar(t, archive, []tarEntry{
+		{name: "bin/tool", body: "#!/bin/sh\n"},
+		{name: "tool", link: "bin/tool"},
+	})
+	dir := filepath.Join(tmp, "src")
+	if err := extractArchive("a.tar", archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	files, err := localFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := hash1(files, func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if rev != want {
+		t.Errorf("localSrc() rev = %s, want %s", rev, want)
+	}
+}
@@ -56,6 +56,20 @@ func getOwner(path string) (uid int, gid int, err error) {
 	return
 }
 
+func getNlink(path string) (nlink uint64, err error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		err = fmt.Errorf("failed to get info for %s: %s", path, err)
+		return
+	}
+	nlink = uint64(stat.Nlink)
+	return
+}
+
 func getMtime(path string) (mtime int64, err error) {
 	var info fs.FileInfo
 	info, err = os.Lstat(path)
@@ -13,6 +13,10 @@ func getOwner(string) (int, int, error) {
 	return 0, 0, fmt.Errorf("getOwner is not implemented for windows")
 }
 
+func getNlink(string) (uint64, error) {
+	return 0, fmt.Errorf("getNlink is not implemented for windows")
+}
+
 func getMtime(string) (int64, error) {
 	return 0, fmt.Errorf("getMtime is not implemented for windows")
 }
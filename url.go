@@ -1,22 +1,197 @@
 package main
 
-import "net/http"
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
 
+// urlttl is how long resolved import urls are cached.
+const urlttl = 24 * time.Hour
+
+var (
+	metaTag  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttr = regexp.MustCompile(
+		`(?is)(name|content)\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// realUrl resolves an import url to the location of its repository.
+// Mappings in RUNIMPORTMAP are used first, followed by a cached resolution.
+// Otherwise, the url is fetched, and the repository is taken from a
+// run-import or go-import meta tag if the page has one, or from the
+// final url after redirects if not.
 func realUrl(url string) (string, error) {
-	client := &http.Client{
-		CheckRedirect: func(r *http.Request, _ []*http.Request) error {
-			if r.Response.StatusCode >= 300 && r.Response.StatusCode < 400 {
-				return nil
-			}
-			return http.ErrUseLastResponse
-		},
+	if repo, ok := mappedUrl(url); ok {
+		return repo, nil
 	}
+	if repo, ok := cachedUrl(url); ok {
+		return repo, nil
+	}
+	repo, err := fetchRealUrl(url)
+	if err != nil {
+		return "", err
+	}
+	cacheUrl(url, repo)
+	return repo, nil
+}
 
-	resp, err := client.Get(url)
+func fetchRealUrl(url string) (string, error) {
+	// Ask for the meta tags, as the go command does with go-get=1.
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("run-get", "1")
+	q.Set("go-get", "1")
+	u.RawQuery = q.Encode()
+	resp, err := fetchMeta(u.String())
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	return resp.Request.URL.String(), nil
+	if resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden {
+		return "", authError(url)
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return "", err
+		}
+		if repo, ok := metaUrl(url, string(body)); ok {
+			return repo, nil
+		}
+	}
+
+	final := *resp.Request.URL
+	q = final.Query()
+	q.Del("run-get")
+	q.Del("go-get")
+	final.RawQuery = q.Encode()
+	return final.String(), nil
+}
+
+// fetchMeta gets url with the credentials configured for its host. If the
+// host asks for credentials that were not sent, it is asked again with any
+// found by hostCredential's fallbacks.
+func fetchMeta(url string) (*http.Response, error) {
+	client := &http.Client{CheckRedirect: authRedirect}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorize(req, false)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+		resp.Request.Header.Get("Authorization") != "" {
+		return resp, err
+	}
+	retry, err := http.NewRequest(http.MethodGet,
+		resp.Request.URL.String(), nil)
+	if err != nil || !authorize(retry, true) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return client.Do(retry)
+}
+
+// metaUrl finds the repository for url in a page's meta tags.
+// run-import tags take precedence over go-import tags. Both have the form:
+//
+//	<meta name="run-import" content="PREFIX VCS REPO">
+//
+// go-import tags are only used if VCS is git.
+func metaUrl(url, page string) (string, bool) {
+	path := strings.TrimSuffix(trimScheme(url), "/")
+	var goRepo string
+	for _, tag := range metaTag.FindAllString(page, -1) {
+		var name, content string
+		for _, m := range metaAttr.FindAllStringSubmatch(tag, -1) {
+			v := m[2][1 : len(m[2])-1]
+			if strings.EqualFold(m[1], "name") {
+				name = v
+			} else {
+				content = v
+			}
+		}
+		f := strings.Fields(content)
+		if len(f) != 3 {
+			continue
+		}
+		if f[0] != path && !strings.HasPrefix(path, f[0]+"/") {
+			continue
+		}
+		switch {
+		case name == "run-import":
+			return f[2], true
+		case name == "go-import" && f[1] == "git" && goRepo == "":
+			goRepo = f[2]
+		}
+	}
+	return goRepo, goRepo != ""
+}
+
+// mappedUrl applies RUNIMPORTMAP, a comma-separated list of PREFIX=REPO
+// entries, to url. The longest matching prefix wins.
+func mappedUrl(url string) (string, bool) {
+	path := trimScheme(url)
+	var best, repo string
+	for _, entry := range strings.Split(os.Getenv("RUNIMPORTMAP"), ",") {
+		prefix, to, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		prefix = strings.TrimSuffix(trimScheme(prefix), "/")
+		if !ok || len(prefix) <= len(best) {
+			continue
+		}
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			best = prefix
+			repo = strings.TrimSuffix(to, "/") + path[len(prefix):]
+		}
+	}
+	return repo, best != ""
+}
+
+func trimScheme(url string) string {
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		return rest
+	}
+	return url
+}
+
+func urlCachePath(url string) (string, error) {
+	dir, err := cacheDir("urls")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum([]byte(url)))), nil
+}
+
+func cachedUrl(url string) (string, bool) {
+	path, err := urlCachePath(url)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > urlttl {
+		return "", false
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil || len(buf) == 0 {
+		return "", false
+	}
+	return string(buf), true
+}
+
+func cacheUrl(url, repo string) {
+	if path, err := urlCachePath(url); err == nil {
+		_ = os.WriteFile(path, []byte(repo), 0644)
+	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetaUrl(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		page string
+		want string
+	}{{
+		name: "run-import",
+		url:  "https://example.com/pkg",
+		page: `<meta name="run-import" ` +
+			`content="example.com/pkg git https://git.example.com/pkg">`,
+		want: "https://git.example.com/pkg",
+	}, {
+		name: "go-import",
+		url:  "https://example.com/pkg",
+		page: `<meta name="go-import" ` +
+			`content="example.com/pkg git https://git.example.com/pkg">`,
+		want: "https://git.example.com/pkg",
+	}, {
+		name: "run-import over go-import",
+		url:  "https://example.com/pkg",
+		page: `<meta name="go-import" content="example.com/pkg git go">` +
+			`<meta name="run-import" content="example.com/pkg git run">`,
+		want: "run",
+	}, {
+		name: "go-import not git",
+		url:  "https://example.com/pkg",
+		page: `<meta name="go-import" content="example.com/pkg hg repo">`,
+		want: "",
+	}, {
+		name: "prefix",
+		url:  "https://example.com/pkg/sub/",
+		page: `<META content='example.com/pkg git repo' NAME='run-import'>`,
+		want: "repo",
+	}, {
+		name: "other prefix",
+		url:  "https://example.com/pkgs",
+		page: `<meta name="run-import" content="example.com/pkg git repo">`,
+		want: "",
+	}, {
+		name: "no tags",
+		url:  "https://example.com/pkg",
+		page: `<html><head><title>pkg</title></head></html>`,
+		want: "",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := metaUrl(tt.url, tt.page)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("metaUrl(%q) = %q, %v, want %q",
+					tt.url, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappedUrl(t *testing.T) {
+	t.Setenv("RUNIMPORTMAP", "example.com/=https://mirror.test/ex, "+
+		"https://example.com/pkg/sub=file:///src/sub,bad")
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/pkg", "https://mirror.test/ex/pkg"},
+		{"example.com/pkg/sub", "file:///src/sub"},
+		{"https://example.com/pkg/sub/x", "file:///src/sub/x"},
+		{"https://example.com/pkg/subx", "https://mirror.test/ex/pkg/subx"},
+		{"https://example.org/pkg", ""},
+	}
+	for _, tt := range tests {
+		got, ok := mappedUrl(tt.url)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("mappedUrl(%q) = %q, %v, want %q",
+				tt.url, got, ok, tt.want)
+		}
+	}
+}
+
+func TestFetchRealUrl(t *testing.T) {
+	t.Setenv("RUNAUTH", "")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/old" {
+				http.Redirect(w, r, "/new?"+r.URL.RawQuery,
+					http.StatusMovedPermanently)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			if r.URL.Path == "/meta" && r.FormValue("run-get") == "1" {
+				fmt.Fprintf(w, `<meta name="run-import" `+
+					`content="%s/meta git https://repo.test/meta">`,
+					r.Host)
+			}
+		}))
+	defer srv.Close()
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/meta", "https://repo.test/meta"},
+		{"/old", srv.URL + "/new"},
+	}
+	for _, tt := range tests {
+		got, err := fetchRealUrl(srv.URL + tt.path)
+		if err != nil {
+			t.Fatalf("fetchRealUrl(%q) err: %v", tt.path, err)
+		}
+		if got != tt.want {
+			t.Errorf("fetchRealUrl(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// vendorOk remembers vendored packages that have already been verified.
+var vendorOk sync.Map
+
+func vendorDir() string {
+	return filepath.Join(root, ".run", "vendor")
+}
+
+// vendored returns the vendored copy of the package with the given store id.
+// It fails if the copy no longer hashes to id.
+func vendored(id string) (string, bool, error) {
+	path := filepath.Join(vendorDir(), id)
+	if _, err := os.Stat(path); err != nil {
+		return "", false, nil
+	}
+	if _, ok := vendorOk.Load(id); ok {
+		return path, true, nil
+	}
+	hash, err := hashDir(path, "", hash1)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to hash '%s': %w", path, err)
+	} else if hash != id {
+		return "", false, fmt.Errorf(
+			"vendored package '%s' does not match its hash: got %s",
+			path, hash)
+	}
+	vendorOk.Store(id, true)
+	return path, true, nil
+}
+
+// pkgDir returns the directory of the package with the given id,
+// preferring a vendored copy over the store.
+func pkgDir(id string) (string, error) {
+	if path, ok, err := vendored(id); err != nil || ok {
+		return path, err
+	}
+	store, err := cacheDir("store")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(store, id)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("failed to find package '%s': %w", id, err)
+	}
+	return path, nil
+}
+
+// vendorPackages copies every package in the project's .runlock into
+// .run/vendor and removes vendored packages that are no longer locked.
+// Packages imported by other packages are locked first, so that they are
+// vendored too.
+func vendorPackages(env *runEnv) error {
+	err := walkImports(env, func(int, *runEnv, pkgImport, bool) {})
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for url := range env.locks {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	keep := make(map[string]bool)
+	for _, url := range urls {
+		src, err := pkgPath(env, url)
+		if err != nil {
+			return fmt.Errorf("failed to get '%s': %w", url, err)
+		}
+		id := filepath.Base(src)
+		dst := filepath.Join(vendorDir(), id)
+		keep[id] = true
+		env.lockids[url] = id
+		if src == dst {
+			continue
+		} else if _, ok, _ := vendored(id); ok {
+			continue
+		}
+		if err := removeAll(dst); err != nil { // A partial copy, if any.
+			return fmt.Errorf("failed to remove '%s': %w", dst, err)
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "vendoring %s\n", url)
+		}
+		if err := copyTree(src, dst); err != nil {
+			return fmt.Errorf("failed to vendor '%s': %w", url, err)
+		}
+		if _, _, err := vendored(id); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(vendorDir())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read vendor directory: %w", err)
+	}
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			path := filepath.Join(vendorDir(), e.Name())
+			if err := removeAll(path); err != nil {
+				return fmt.Errorf("failed to remove '%s': %w", path, err)
+			}
+		}
+	}
+	return env.WriteLocks()
+}